@@ -0,0 +1,61 @@
+package funcache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// How many aliases are followed when resolving a key, at most.
+const maxAliasDepth = 8
+
+// Alias registers alias as another name for the canonical key. Looking up the
+// alias (e.g. with Cache) is then the same as looking up the canonical key, so
+// values are only stored once. Aliases can point to other aliases, but only up
+// to 8 are followed. Alias panics if it would create a cycle, of any length.
+func (cache *Cache) Alias(alias, canonical interface{}) {
+	alias, canonical = cache.scope(alias), cache.scope(canonical)
+	cache.aliases.Lock()
+	defer cache.aliases.Unlock()
+	if cache.aliases.m == nil {
+		cache.aliases.m = make(map[interface{}]interface{})
+	}
+	// Follow the whole chain, not just as far as resolve does, to catch cycles
+	// of any length. There are none yet, so it ends.
+	for key, ok := canonical, true; ok; key, ok = cache.aliases.m[key] {
+		if key == alias {
+			panic(fmt.Sprintf("funcache: alias cycle on key %v", alias))
+		}
+	}
+	cache.aliases.m[alias] = canonical
+	atomic.StoreUint32(&cache.aliases.active, 1)
+}
+
+// Resolve any aliases, returning the canonical key. Keys are scoped to the
+// namespace first.
+func (cache *Cache) resolve(key interface{}) interface{} {
+	key = cache.scope(key)
+	if atomic.LoadUint32(&cache.aliases.active) == 0 {
+		return key
+	}
+	cache.aliases.RLock()
+	defer cache.aliases.RUnlock()
+	for depth := 0; depth < maxAliasDepth; depth++ {
+		next, ok := cache.aliases.m[key]
+		if !ok {
+			break
+		}
+		key = next
+	}
+	return key
+}
+
+// -----------------------------------------------------------------------------
+// Map of aliases to keys, safe for concurrent access. While it's empty,
+// resolving keys is cheap.
+
+type aliasMap struct {
+	active uint32
+	sync.RWMutex
+	m map[interface{}]interface{}
+}
@@ -0,0 +1,122 @@
+package funcache
+
+// BatchStore is a Store which can get and add many keys at once, e.g. in one
+// round trip to a remote store. MultiCache, Warm and Snapshot use it, if they
+// can; otherwise they get and add keys one at a time. The in-memory store made
+// by NewInMemCache is one.
+//
+// GetMulti returns the values found for any of the keys, by the keys given,
+// leaving out any that aren't stored. AddMulti stores all the values given, by
+// key.
+type BatchStore interface {
+	Store
+	GetMulti(keys []interface{}) map[interface{}]interface{}
+	AddMulti(values map[interface{}]interface{})
+}
+
+// MultiCache looks up all the given keys, and returns their values. Any which
+// aren't cached (or are being busted) are loaded with a single call to loader,
+// which is passed just the missing keys, and returns their values. Everything
+// it returns is cached. Keys it doesn't return a value for are left out of the
+// result, and not cached.
+//
+// If the store is a BatchStore, keys are got and added all at once; otherwise,
+// one at a time.
+func (cache *Cache) MultiCache(keys []interface{}, loader func(missing []interface{}) map[interface{}]interface{}) map[interface{}]interface{} {
+	values := make(map[interface{}]interface{}, len(keys))
+	resolved := make(map[interface{}]interface{}, len(keys)) // Keys given, by resolved key
+	var order, stored []interface{}                          // Resolved keys
+	busting := cache.isBusting()
+	for _, key := range keys {
+		rkey := cache.resolve(key)
+		if _, ok := resolved[rkey]; ok {
+			continue // Duplicate
+		}
+		resolved[rkey] = key
+		order = append(order, rkey)
+		if !busting && !cache.isBustedKey(rkey) {
+			stored = append(stored, rkey)
+		}
+	}
+	found := cache.getMulti(stored)
+
+	var missing []interface{}
+	for _, rkey := range order {
+		key := resolved[rkey]
+		busted := busting || cache.isBustedKey(rkey)
+		value, ok := cache.overridden(rkey)
+		if !ok {
+			if data, inStore := found[rkey]; inStore {
+				value, ok = cache.unwrap(data)
+			}
+		}
+		if ok && cache.typeGuard != nil && !cache.checkType(rkey, value) {
+			ok = false
+		}
+		cache.count(rkey, value, ok, busted)
+		if ok {
+			values[key] = value
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return values
+	}
+
+	loaded := loader(missing)
+	toAdd := make(map[interface{}]interface{}, len(loaded))
+	for key, value := range loaded {
+		values[key] = value
+		toAdd[cache.resolve(key)] = value
+	}
+	cache.addMulti(toAdd)
+	return values
+}
+
+// Get the data for all the keys from the store, leaving out any not found.
+func (cache *Cache) getMulti(keys []interface{}) map[interface{}]interface{} {
+	if len(keys) == 0 {
+		return nil
+	}
+	if store, ok := cache.store.(BatchStore); ok {
+		return store.GetMulti(keys)
+	}
+	found := make(map[interface{}]interface{}, len(keys))
+	for _, key := range keys {
+		if data, ok := cache.store.Get(key); ok {
+			found[key] = data
+		}
+	}
+	return found
+}
+
+// Store the values for all the keys, like add.
+func (cache *Cache) addMulti(values map[interface{}]interface{}) {
+	store, ok := cache.store.(BatchStore)
+	if !ok {
+		for key, value := range values {
+			cache.add(key, value)
+		}
+		return
+	}
+	var olds map[interface{}]interface{}
+	if cache.onReplace != nil {
+		keys := make([]interface{}, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		olds = store.GetMulti(keys)
+	}
+	batch := make(map[interface{}]interface{}, len(values))
+	for key, value := range values {
+		if value != nil || !cache.noCacheNil {
+			batch[key] = cache.expiring(value)
+		}
+	}
+	store.AddMulti(batch)
+	for key, data := range batch {
+		old, replacing := olds[key]
+		cache.added(key, data, old, replacing)
+	}
+}
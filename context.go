@@ -0,0 +1,197 @@
+package funcache
+
+import (
+	"context"
+	"sync"
+)
+
+// Holds the cache of a context from WithRequestCache.
+type requestCacheKey struct{}
+
+// WithRequestCache returns a context derived from ctx, such as that of an HTTP
+// request, which carries an in-memory cache of its own; see RequestCache. The
+// cache lives in the context, so it's garbage collected along with it. When
+// ctx is done, the cache is emptied, so values can't leak from one request to
+// the next.
+func WithRequestCache(ctx context.Context) context.Context {
+	store := newSyncMap()
+	context.AfterFunc(ctx, func() {
+		store.Lock()
+		store.m = make(map[interface{}]interface{})
+		store.Unlock()
+	})
+	return context.WithValue(ctx, requestCacheKey{}, New(store))
+}
+
+// RequestCache returns the cache carried by the given context (or the one it
+// was derived from), from WithRequestCache. Each such context gets its own. If
+// there isn't one, or the context is done, the cache returned doesn't store
+// anything.
+func RequestCache(ctx context.Context) *Cache {
+	if ctx.Err() != nil {
+		return nilCache()
+	}
+	if cache, ok := ctx.Value(requestCacheKey{}).(*Cache); ok {
+		return cache
+	}
+	return nilCache()
+}
+
+// Marks a context as busting a cache, for CacheCtx.
+type bustCtxKey struct{ cache *Cache }
+
+// BustCtx calls the given function with a context derived from ctx, which makes
+// any calls to CacheCtx with it (or with contexts derived from it) recompute
+// their values, like with Bust. Unlike Bust, this works across goroutines, and
+// doesn't need to walk the stack; the context just has to be passed along. So
+// busting this way doesn't slow down any other callers, either.
+func (cache *Cache) BustCtx(ctx context.Context, fn func(ctx context.Context)) {
+	fn(context.WithValue(ctx, bustCtxKey{cache}, true))
+}
+
+// CacheCtx caches the return value of the function, like Cache, except that
+// it's also busted if the given context came from BustCtx (or only then,
+// WithContextBusting). The function is passed the context, to pass along to any
+// nested calls.
+func (cache *Cache) CacheCtx(ctx context.Context, key interface{}, fn func(ctx context.Context) interface{}) interface{} {
+	value, _ := cache.cacheHit(key, cache.ctxBustMode(ctx), nil, func() interface{} { return fn(ctx) })
+	return value
+}
+
+// Always bust if the context came from BustCtx for this cache, otherwise only
+// if called from within Bust (unless WithContextBusting).
+func (cache *Cache) ctxBustMode(ctx context.Context) bustMode {
+	if ctx.Value(bustCtxKey{cache}) != nil {
+		return bustAlways
+	}
+	if cache.ctxBustingOnly {
+		return bustNever
+	}
+	return bustByStack
+}
+
+// CacheContext caches the return value of a function that takes a context and
+// can fail, like CacheErr, for functions doing I/O that should be cancellable.
+// It's busted by Bust, or by contexts from BustCtx, like CacheCtx.
+//
+// Concurrent calls for the same key share one call to the function, as with
+// Cache. It's passed a context with the values of the first caller's, but which
+// is only cancelled once every caller waiting on it has given up. A caller
+// whose context is done returns its error straight away, without waiting. If
+// the function returns an error, or its context is cancelled, nothing is
+// cached (except ErrNotFound, WithNegativeTTL).
+func (cache *Cache) CacheContext(ctx context.Context, key interface{}, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	key = cache.resolve(key)
+	value, ok, busted := cache.getAs(key, cache.ctxBustMode(ctx), nil)
+	if ok {
+		if isNotFound(value) {
+			return nil, value.(error)
+		}
+		return value, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cache.detectCycles {
+		defer cache.checkCycle(key)()
+	}
+	return cache.ctxCalls.do(ctx, key, !busted, func(ctx context.Context) (interface{}, error) {
+		var err error
+		value := cache.compute(key, func() interface{} { // On the loading goroutine
+			var value interface{}
+			value, err = fn(ctx)
+			return value
+		})
+		if err == nil {
+			err = ctx.Err()
+		}
+		switch {
+		case err == nil:
+			cache.add(key, value)
+		case cache.negativeTTL > 0 && isNotFound(err):
+			cache.add(key, err)
+		}
+		return value, err
+	})
+}
+
+// -----------------------------------------------------------------------------
+// Calls in flight for CacheContext, like callGroup, except that each runs on
+// its own goroutine, so that callers can stop waiting on it. It's cancelled
+// once they all have.
+
+type ctxCallGroup struct {
+	sync.Mutex
+	m map[interface{}]*ctxCall
+}
+
+type ctxCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int // Guarded by the group's lock
+
+	value    interface{}
+	err      error
+	panicked bool
+	panicVal interface{}
+}
+
+func (g *ctxCallGroup) do(ctx context.Context, key interface{}, join bool, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	c, ok := g.m[key]
+	if !ok || !join {
+		c = g.start(ctx, key, !ok, fn)
+	}
+	c.waiters++
+	g.Unlock()
+
+	select {
+	case <-c.done:
+		if c.panicked {
+			panic(c.panicVal)
+		}
+		return c.value, c.err
+	case <-ctx.Done():
+		g.Lock()
+		if c.waiters--; c.waiters == 0 {
+			c.cancel()
+			g.forget(key, c) // Don't let anyone else join a cancelled call
+		}
+		g.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Start a call on its own goroutine, letting others join it if shared. Must be
+// called with the lock held.
+func (g *ctxCallGroup) start(ctx context.Context, key interface{}, shared bool, fn func(ctx context.Context) (interface{}, error)) *ctxCall {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c := &ctxCall{done: make(chan struct{}), cancel: cancel}
+	if shared {
+		if g.m == nil {
+			g.m = make(map[interface{}]*ctxCall)
+		}
+		g.m[key] = c
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				c.panicked, c.panicVal = true, r
+			}
+			cancel()
+			g.Lock()
+			g.forget(key, c)
+			g.Unlock()
+			close(c.done)
+		}()
+		c.value, c.err = fn(ctx)
+	}()
+	return c
+}
+
+// Stop sharing the call, if it still is. Must be called with the lock held.
+func (g *ctxCallGroup) forget(key interface{}, c *ctxCall) {
+	if g.m[key] == c {
+		delete(g.m, key)
+	}
+}
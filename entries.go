@@ -0,0 +1,199 @@
+package funcache
+
+import "time"
+
+// Some methods store extra information alongside values, wrapping them up in
+// their own types. Use the same method for reading and writing any given key.
+
+type etagEntry struct {
+	value interface{}
+	etag  string
+}
+
+func isETagEntry(data interface{}) bool {
+	_, ok := data.(etagEntry)
+	return ok
+}
+
+// CacheETag caches the value returned by the function, like Cache, along with
+// an ETag for it. Both are returned, whether the value was cached or not. This
+// lets an HTTP handler answer If-None-Match without reserializing the value.
+func (cache *Cache) CacheETag(key interface{}, fn func() (value interface{}, etag string)) (value interface{}, etag string) {
+	key = cache.resolve(key)
+	if data, ok, _ := cache.getAs(key, bustByStack, isETagEntry); ok {
+		entry := data.(etagEntry)
+		return entry.value, entry.etag
+	}
+	entry := cache.compute(key, func() interface{} {
+		value, etag := fn()
+		return etagEntry{value, etag}
+	}).(etagEntry)
+	cache.add(key, entry)
+	return entry.value, entry.etag
+}
+
+// ETag returns the ETag of the value cached under the given key by CacheETag,
+// if there is one. It reads the store directly, without any busting.
+func (cache *Cache) ETag(key interface{}) (etag string, ok bool) {
+	key = cache.resolve(key)
+	if data, ok := cache.store.Get(key); ok {
+		if value, ok := cache.unwrap(data); ok {
+			if entry, ok := value.(etagEntry); ok {
+				return entry.etag, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Both return values of a function, kept together so they're cached and
+// busted as one.
+type pairEntry struct {
+	first, second interface{}
+}
+
+func isPairEntry(data interface{}) bool {
+	_, ok := data.(pairEntry)
+	return ok
+}
+
+// Cache2 caches both return values of the function, like Cache. This suits
+// functions returning something like (T, bool), without wrapping them up in a
+// struct. They're stored together, so they're always cached, and recomputed
+// (e.g. by Bust), as a pair.
+func (cache *Cache) Cache2(key interface{}, fn func() (interface{}, interface{})) (interface{}, interface{}) {
+	data, _ := cache.cacheHit(key, bustByStack, isPairEntry, func() interface{} {
+		first, second := fn()
+		return pairEntry{first, second}
+	})
+	entry := data.(pairEntry)
+	return entry.first, entry.second
+}
+
+// Wrap2 is the same as Cache2, except that it auto-assigns a cache key, which
+// is just the function name.
+func (cache *Cache) Wrap2(fn func() (interface{}, interface{})) (interface{}, interface{}) {
+	return cache.Cache2(getFnName(fn), fn)
+}
+
+type metaEntry struct {
+	value interface{}
+	meta  map[string]interface{}
+}
+
+func isMetaEntry(data interface{}) bool {
+	_, ok := data.(metaEntry)
+	return ok
+}
+
+// CacheMeta caches the value returned by the function, like Cache, and stores
+// the given metadata alongside it (e.g. a source system or trace ID). The
+// metadata is only kept when the value is computed; it plays no part in keying
+// or in deciding hits and misses.
+func (cache *Cache) CacheMeta(key interface{}, meta map[string]interface{}, fn func() interface{}) interface{} {
+	key = cache.resolve(key)
+	if data, ok, _ := cache.getAs(key, bustByStack, isMetaEntry); ok {
+		return data.(metaEntry).value
+	}
+	value := cache.compute(key, fn)
+	cache.add(key, metaEntry{value, meta})
+	return value
+}
+
+// Meta returns the metadata stored with the value cached under the given key by
+// CacheMeta, if there is one. It reads the store directly, without any busting.
+func (cache *Cache) Meta(key interface{}) (meta map[string]interface{}, ok bool) {
+	key = cache.resolve(key)
+	if data, ok := cache.store.Get(key); ok {
+		if value, ok := cache.unwrap(data); ok {
+			if entry, ok := value.(metaEntry); ok {
+				return entry.meta, true
+			}
+		}
+	}
+	return nil, false
+}
+
+type versionEntry struct {
+	value   interface{}
+	version string
+}
+
+func isVersionEntry(data interface{}) bool {
+	_, ok := data.(versionEntry)
+	return ok
+}
+
+// CacheVersioned caches the value returned by fn, like Cache, along with a
+// version token from currentVersion (e.g. a DB sequence or file mtime). On a
+// hit, currentVersion is called again, and the value is only recomputed if the
+// token has changed. This suits data sources where checking the version is much
+// cheaper than fetching the value.
+//
+// If either function returns an error, it's returned and nothing is cached.
+func (cache *Cache) CacheVersioned(key interface{}, currentVersion func() (string, error), fn func() (interface{}, error)) (interface{}, error) {
+	key = cache.resolve(key)
+	version, err := currentVersion()
+	if err != nil {
+		return nil, err
+	}
+	if data, ok, _ := cache.getAs(key, bustByStack, isVersionEntry); ok {
+		if entry := data.(versionEntry); entry.version == version {
+			return entry.value, nil
+		}
+	}
+	value := cache.compute(key, func() interface{} {
+		var value interface{}
+		value, err = fn()
+		return value
+	})
+	if err != nil {
+		return nil, err
+	}
+	cache.add(key, versionEntry{value, version})
+	return value, nil
+}
+
+type staleEntry struct {
+	value      interface{}
+	freshUntil time.Time
+}
+
+func isStaleEntry(data interface{}) bool {
+	_, ok := data.(staleEntry)
+	return ok
+}
+
+// CacheStale caches the return value of the function, like CacheWithTTL, except
+// that once the value is older than the TTL, it's still returned for a while
+// (staleFor) as it's refreshed in the background. Only one refresh runs at a
+// time. Once the value is older than ttl + staleFor, callers wait for a fresh
+// one, as usual. This saves the unlucky caller that finds a value expired from
+// waiting for it to be recomputed.
+//
+// If a background refresh panics, the stale value is kept, and the next call
+// tries again.
+func (cache *Cache) CacheStale(key interface{}, ttl, staleFor time.Duration, fn func() interface{}) interface{} {
+	key = cache.resolve(key)
+	refresh := func() interface{} {
+		value := cache.compute(key, fn)
+		now := cache.clock.Now()
+		cache.add(key, ttlEntry{staleEntry{value, now.Add(ttl)}, now.Add(ttl + staleFor)})
+		return value
+	}
+	data, ok, busted := cache.getAs(key, bustByStack, isStaleEntry)
+	if !ok {
+		return cache.calls.do(key, !busted, refresh)
+	}
+	entry := data.(staleEntry)
+	if cache.clock.Now().Before(entry.freshUntil) {
+		return entry.value
+	}
+	if !cache.calls.inFlight(key) {
+		go func() {
+			defer func() { recover() }()
+			cache.calls.do(key, true, refresh)
+		}()
+	}
+	return entry.value
+}
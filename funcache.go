@@ -2,8 +2,12 @@
 package funcache
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Store is any backing store used by the cache. Note that the cache doesn't do
@@ -15,8 +19,40 @@ type Store interface {
 
 	// Contains(key interface{}) bool
 	// Peek(key interface{}) (interface{}, bool)
-	// Purge()
-	// Remove(key interface{})
+}
+
+// RemovableStore is a Store which can also remove keys. Methods which drop
+// values from the cache need the store to implement this.
+type RemovableStore interface {
+	Store
+	Remove(key interface{})
+}
+
+// PurgeableStore is a Store which can remove all its keys at once.
+type PurgeableStore interface {
+	Store
+	Purge()
+}
+
+// CountableStore is a Store which can count its entries.
+type CountableStore interface {
+	Store
+	Len() int
+}
+
+// EnumerableStore is a Store which can list its keys.
+type EnumerableStore interface {
+	Store
+	Keys() []interface{}
+}
+
+// EvictNotifier is a Store which can say when it evicts values by itself, e.g.
+// to make room for others. The cache sets the callback when it's created, so
+// that it can call the hook set by WithOnEvict. The callback isn't for values
+// which are removed or replaced.
+type EvictNotifier interface {
+	Store
+	SetEvictCallback(fn func(key, value interface{}))
 }
 
 // -----------------------------------------------------------------------------
@@ -26,6 +62,10 @@ type nilStore struct{}
 
 func (*nilStore) Add(key, value interface{})                       { return }
 func (*nilStore) Get(key interface{}) (value interface{}, ok bool) { return }
+func (*nilStore) Remove(key interface{})                           { return }
+func (*nilStore) Purge()                                           { return }
+func (*nilStore) Len() int                                         { return 0 }
+func (*nilStore) Keys() []interface{}                              { return nil }
 
 func nilCache() *Cache { return New(&nilStore{}) }
 
@@ -37,97 +77,1363 @@ type syncMap struct {
 	m map[interface{}]interface{}
 }
 
-func newSyncMap() *syncMap {
-	return &syncMap{m: make(map[interface{}]interface{})}
+func newSyncMap() *syncMap { return newSyncMapSize(0) }
+
+func newSyncMapSize(hint int) *syncMap {
+	return &syncMap{m: make(map[interface{}]interface{}, hint)}
 }
 
 func (sm *syncMap) Add(key, value interface{}) {
+	key = normalizeKey(key)
 	sm.Lock()
 	defer sm.Unlock()
 	sm.m[key] = value
 }
 
 func (sm *syncMap) Get(key interface{}) (value interface{}, ok bool) {
+	key = normalizeKey(key)
 	sm.RLock()
 	defer sm.RUnlock()
 	value, ok = sm.m[key]
 	return
 }
 
+// Get all the keys under one lock, rather than one each.
+func (sm *syncMap) GetMulti(keys []interface{}) map[interface{}]interface{} {
+	found := make(map[interface{}]interface{}, len(keys))
+	sm.RLock()
+	defer sm.RUnlock()
+	for _, key := range keys {
+		if value, ok := sm.m[normalizeKey(key)]; ok {
+			found[key] = value
+		}
+	}
+	return found
+}
+
+func (sm *syncMap) AddMulti(values map[interface{}]interface{}) {
+	sm.Lock()
+	defer sm.Unlock()
+	for key, value := range values {
+		sm.m[normalizeKey(key)] = value
+	}
+}
+
+func (sm *syncMap) Remove(key interface{}) {
+	key = normalizeKey(key)
+	sm.Lock()
+	defer sm.Unlock()
+	delete(sm.m, key)
+}
+
+func (sm *syncMap) Purge() {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.m = make(map[interface{}]interface{})
+}
+
+func (sm *syncMap) snapshot() map[interface{}]interface{} {
+	sm.RLock()
+	defer sm.RUnlock()
+	m := make(map[interface{}]interface{}, len(sm.m))
+	for k, v := range sm.m {
+		m[k] = v
+	}
+	return m
+}
+
+// The entries are copied out first, so that fn isn't called under the lock, and
+// can write to the map.
+func (sm *syncMap) rangeData(fn func(key, data interface{}) bool) {
+	sm.RLock()
+	entries := make([]KeyValue, 0, len(sm.m))
+	for k, v := range sm.m {
+		entries = append(entries, KeyValue{k, v})
+	}
+	sm.RUnlock()
+	for _, entry := range entries {
+		if !fn(entry.Key, entry.Value) {
+			return
+		}
+	}
+}
+
+func (sm *syncMap) Len() int {
+	sm.RLock()
+	defer sm.RUnlock()
+	return len(sm.m)
+}
+
+func (sm *syncMap) Keys() []interface{} {
+	sm.RLock()
+	defer sm.RUnlock()
+	return mapKeys(sm.m)
+}
+
 // -----------------------------------------------------------------------------
 // Copy-on-write in-memory map, safe for concurrent access.
+//
+// Reads are lock-free, and as fast as a plain map. Each write copies the whole
+// map, so costs O(n), and writers take turns. But writes don't wait alone: any
+// made while another writer is copying are queued up, and then applied together
+// in a single copy by whichever writer goes next. So under many concurrent
+// writers, there are far fewer copies than writes.
 
 type cowMap struct {
-	sync.Mutex // Used only when writing
+	sync.Mutex // Used only when writing, held while copying
 	m          atomic.Value
+	capacity   int // The least each copy is sized for
+
+	pendingMu sync.Mutex
+	pending   []cowWrite // Writes waiting to be copied in
 }
 
-func newCopyOnWriteMap() *cowMap {
-	cm := &cowMap{}
-	cm.m.Store(make(map[interface{}]interface{}))
+type cowWrite struct {
+	key, value interface{}
+	remove     bool
+}
+
+func newCopyOnWriteMap() *cowMap { return newCopyOnWriteMapSize(0) }
+
+func newCopyOnWriteMapSize(capacity int) *cowMap {
+	cm := &cowMap{capacity: capacity}
+	cm.m.Store(make(map[interface{}]interface{}, capacity))
 	return cm
 }
 
 func (cm *cowMap) Add(key, value interface{}) {
+	cm.write(cowWrite{key: normalizeKey(key), value: value})
+}
+
+// Queue up the write, then apply it along with any others queued, unless some
+// other writer gets to them all first. Either way, it's applied by the time
+// this returns.
+func (cm *cowMap) write(w cowWrite) {
+	cm.pendingMu.Lock()
+	cm.pending = append(cm.pending, w)
+	cm.pendingMu.Unlock()
+
 	cm.Lock()
 	defer cm.Unlock()
+	cm.pendingMu.Lock()
+	writes := cm.pending
+	cm.pending = nil
+	cm.pendingMu.Unlock()
+	if len(writes) == 0 {
+		return // Already applied
+	}
+
 	m1 := cm.m.Load().(map[interface{}]interface{})
-	m2 := make(map[interface{}]interface{})
+	if len(writes) == 1 && writes[0].remove {
+		if _, ok := m1[writes[0].key]; !ok {
+			return // Nothing to remove, so no need to copy
+		}
+	}
+	size := len(m1) + len(writes)
+	if size < cm.capacity {
+		size = cm.capacity
+	}
+	m2 := make(map[interface{}]interface{}, size)
 	for k, v := range m1 {
 		m2[k] = v
 	}
-	m2[key] = value
+	for _, w := range writes {
+		if w.remove {
+			delete(m2, w.key)
+		} else {
+			m2[w.key] = w.value
+		}
+	}
 	cm.m.Store(m2)
 }
 
 func (cm *cowMap) Get(key interface{}) (value interface{}, ok bool) {
+	key = normalizeKey(key)
 	m := cm.m.Load().(map[interface{}]interface{})
 	value, ok = m[key]
 	return
 }
 
+func (cm *cowMap) Remove(key interface{}) {
+	cm.write(cowWrite{key: normalizeKey(key), remove: true})
+}
+
+// Any writes still queued are dropped, as if they'd been made just before.
+func (cm *cowMap) Purge() {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.pendingMu.Lock()
+	cm.pending = nil
+	cm.pendingMu.Unlock()
+	cm.m.Store(make(map[interface{}]interface{}, cm.capacity))
+}
+
+func (cm *cowMap) snapshot() map[interface{}]interface{} {
+	return cm.m.Load().(map[interface{}]interface{}) // Never modified once stored
+}
+
+func (cm *cowMap) rangeData(fn func(key, data interface{}) bool) {
+	for k, v := range cm.snapshot() {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+func (cm *cowMap) Len() int {
+	return len(cm.m.Load().(map[interface{}]interface{}))
+}
+
+func (cm *cowMap) Keys() []interface{} {
+	return mapKeys(cm.m.Load().(map[interface{}]interface{}))
+}
+
+// -----------------------------------------------------------------------------
+// In-memory map for keys that are written once and read many times, safe for
+// concurrent access. Reads don't contend on any lock.
+
+type concurrentMap struct {
+	m sync.Map
+}
+
+func newConcurrentMap() *concurrentMap { return &concurrentMap{} }
+
+func (cm *concurrentMap) Add(key, value interface{}) {
+	cm.m.Store(normalizeKey(key), value)
+}
+
+func (cm *concurrentMap) Get(key interface{}) (value interface{}, ok bool) {
+	return cm.m.Load(normalizeKey(key))
+}
+
+func (cm *concurrentMap) Remove(key interface{}) {
+	cm.m.Delete(normalizeKey(key))
+}
+
+func (cm *concurrentMap) Purge() {
+	cm.m.Range(func(key, _ interface{}) bool {
+		cm.m.Delete(key)
+		return true
+	})
+}
+
+func (cm *concurrentMap) rangeData(fn func(key, data interface{}) bool) {
+	cm.m.Range(fn)
+}
+
+func (cm *concurrentMap) Len() (n int) {
+	cm.m.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return
+}
+
+func (cm *concurrentMap) Keys() (keys []interface{}) {
+	cm.m.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return
+}
+
+func mapKeys(m map[interface{}]interface{}) []interface{} {
+	keys := make([]interface{}, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 // -----------------------------------------------------------------------------
 
+// Cache caches the values of functions in a store. Namespaced views of a Cache
+// (see Namespace) share all of its state, apart from the namespace.
 type Cache struct {
+	*cacheState
+	namespace string // Prefix for all keys, like "users/", if any
+}
+
+type cacheState struct {
+	// Counters of cache activity, for Stats. These come first so that they're
+	// 64-bit aligned, as needed for atomic access on 32-bit platforms.
+	hits, misses, busts, negativeHits uint64
+
 	store Store
 	// Small optimization: maintain a counter of actively cache busting callers.
 	// If no one is cache busting, then don't go through the extra effort of
-	// checking the caller stack.
-	busting uint32
+	// checking the caller stack. Only so much of it is checked, if limited.
+	busting        uint32
+	maxBustDepth   int
+	noBusting      bool // Busting turned off entirely, by WithBusting(false)
+	ctxBustingOnly bool // Only contexts bust CacheCtx, by WithContextBusting
+
+	// Keys currently being computed, per goroutine. Only tracked when cycle
+	// detection is enabled.
+	detectCycles bool
+	computing    computeSet
+
+	// Used for expiring values, along with how long they last if not given.
+	clock      Clock
+	defaultTTL time.Duration
+
+	// Values refreshing themselves on a schedule.
+	timers timerMap
+
+	// Whether to skip counting hits, misses and busts.
+	noStats bool
+
+	// Reasons given to BustReason, on each goroutine, and the hook to pass them
+	// to when recomputing.
+	bustReasons     goroutineStacks
+	onBustRecompute func(key interface{}, reason string)
+
+	// Called when a value is stored over an older one.
+	onReplace func(key, oldValue, newValue interface{})
+
+	// Called as values are stored, found, or not found.
+	onAdd  func(key, value interface{})
+	onHit  func(key, value interface{})
+	onMiss func(key interface{})
+
+	// Called when the store evicts a value, if it can say so.
+	onEvict func(key, value interface{})
+
+	// Values overridden by WithOverride, on each goroutine.
+	overrides goroutineStacks
+
+	// Sets of keys being busted by BustOnly, on each goroutine.
+	bustedKeys goroutineStacks
+
+	// How many times each key has been looked up, if we're counting.
+	countAccess  bool
+	accessCounts counterMap
+
+	// When each entry was stored, and how often it's been hit since, if we're
+	// tracking.
+	trackEntries bool
+	entries      entryTable
+
+	// Other names for keys.
+	aliases aliasMap
+
+	// Called with partial results from CacheProgress.
+	onProgress func(key, partial interface{})
+
+	// Values found in the store must be of this type, if set.
+	typeGuard      reflect.Type
+	onTypeMismatch func(key, value interface{})
+
+	// Whether nil values are left out of the store, to be computed again.
+	noCacheNil bool
+
+	// Calls to compute values which are in flight, by key. If we're not
+	// blocking on hot keys, stale values are returned instead of waiting.
+	calls              callGroup
+	nonBlockingHotKeys bool
+
+	// Calls in flight for CacheContext, which can be cancelled.
+	ctxCalls ctxCallGroup
+
+	// Locks for operations that need to be atomic on a single key.
+	keyLocks keyMutex
+
+	// When each key was last computed. Only tracked when there's a minimum
+	// time between recomputes.
+	minRecompute time.Duration
+	computedAt   timeMap
+
+	// How long to keep ErrNotFound values, if not forever, plus up to some
+	// random jitter.
+	negativeTTL, negativeJitter time.Duration
+	rand                        lockedRand
+
+	// The fraction of each TTL given to CacheWithTTL to randomly add or take
+	// away, if any.
+	ttlJitter float64
+
+	// Where to report live activity, if anywhere.
+	metrics MetricsHook
+
+	// How long the last load of each key took. Only tracked when timing loads.
+	timeLoads bool
+	loadTimes durationMap
+
+	// Makes copies of values for callers, so they can't change the cached ones.
+	copyOnGet func(value interface{}) interface{}
+
+	// Transforms every key given, before it's used.
+	keyFunc func(key interface{}) interface{}
 }
 
-// New returns a Cache backed by the store you provide.
-func New(store Store) *Cache { return &Cache{store: store} }
+// New returns a Cache backed by the store you provide, configured with any
+// options given.
+func New(store Store, opts ...Option) *Cache {
+	cache := &Cache{cacheState: &cacheState{store: store, clock: systemClock{}}}
+	for _, opt := range opts {
+		opt(cache)
+	}
+	if store, ok := store.(EvictNotifier); ok && (cache.onEvict != nil || cache.trackEntries) {
+		store.SetEvictCallback(cache.evicted)
+	}
+	return cache
+}
+
+// Forget about a value the store has evicted, and let the hook know.
+func (cache *Cache) evicted(key, data interface{}) {
+	if cache.trackEntries {
+		cache.entries.delete(key)
+	}
+	if cache.onEvict != nil {
+		cache.onEvict(key, unexpire(data))
+	}
+}
 
 // NewInMemCache returns a Cache backed by a simple in-memory map, safe for
 // concurrent access.
-func NewInMemCache() *Cache { return New(newSyncMap()) }
+func NewInMemCache(opts ...Option) *Cache { return New(newSyncMap(), opts...) }
+
+// NewSyncMapCache returns a Cache backed by an in-memory sync.Map. This suits
+// read-heavy workloads on many cores better than NewInMemCache, as long as each
+// key is mostly written once and then read many times.
+func NewSyncMapCache(opts ...Option) *Cache { return New(newConcurrentMap(), opts...) }
+
+// NewInMemCacheSize is the same as NewInMemCache, except that the map is sized
+// up front to hold about hint entries. This saves growing it over and over
+// while warming up a large cache.
+func NewInMemCacheSize(hint int, opts ...Option) *Cache {
+	return New(newSyncMapSize(hint), opts...)
+}
+
+// Set stores the given value under the key, as if it had been computed. This
+// warms the cache with a value you already have, without a function to call.
+func (cache *Cache) Set(key, value interface{}) {
+	cache.add(cache.resolve(key), value)
+}
+
+// GetIfPresent returns the value cached under the given key, and whether there
+// is one (that hasn't expired). It never calls any function, and ignores any
+// busting; it's just a read of the store.
+func (cache *Cache) GetIfPresent(key interface{}) (value interface{}, ok bool) {
+	if data, ok := cache.store.Get(cache.resolve(key)); ok {
+		if value, ok := cache.unwrap(data); ok {
+			return cache.copied(value), true
+		}
+	}
+	return nil, false
+}
+
+// Delete removes the value cached under the given key, if there is one, so that
+// it's recomputed next time. Unlike Bust, this affects only that one key. The
+// store must be a RemovableStore; otherwise nothing is removed.
+func (cache *Cache) Delete(key interface{}) {
+	key = cache.resolve(key)
+	if store, ok := cache.store.(RemovableStore); ok {
+		store.Remove(key)
+		cache.entries.delete(key)
+	}
+}
+
+// BustWhere removes the values cached under all the keys for which pred returns
+// true, and returns how many were removed. For a namespaced view, only keys in
+// the namespace are considered, and pred is passed them without their prefix.
+// The store must be both a RemovableStore and an EnumerableStore; otherwise
+// nothing is removed.
+func (cache *Cache) BustWhere(pred func(key interface{}) bool) int {
+	store, ok := cache.store.(RemovableStore)
+	if !ok {
+		return 0
+	}
+	keys, ok := cache.store.(EnumerableStore)
+	if !ok {
+		return 0
+	}
+	var n int
+	for _, key := range keys.Keys() {
+		if unscoped, ok := cache.unscope(key); ok && pred(unscoped) {
+			store.Remove(key)
+			cache.entries.delete(key)
+			n++
+		}
+	}
+	return n
+}
+
+// Clear removes all the values in the cache. The store must be a
+// PurgeableStore, or be both a RemovableStore and an EnumerableStore; otherwise
+// nothing is removed. For a namespaced view, only the values in the namespace
+// are removed, and the store must be both of the latter.
+func (cache *Cache) Clear() {
+	if cache.namespace != "" {
+		cache.clearNamespace()
+		return
+	}
+	switch store := cache.store.(type) {
+	case PurgeableStore:
+		store.Purge()
+	case RemovableStore:
+		keys, ok := cache.store.(EnumerableStore)
+		if !ok {
+			return
+		}
+		for _, key := range keys.Keys() {
+			store.Remove(key)
+		}
+	default:
+		return
+	}
+	cache.entries.deleteIf(func(interface{}, *entryInfo) bool { return true })
+}
 
 // Bust calls the given function, invalidating any cached values in nested
 // function calls.
+//
+// Busting is detected by looking up the calling goroutine's stack, so it only
+// applies to calls made on the same goroutine. Any goroutines started by fn
+// don't bust; use BustScope (or BustCtx and CacheCtx) for that. While anyone is
+// busting, every call to Cache has to walk its stack to see if it's busting
+// too, which slows down unrelated callers. Under heavy concurrent use, prefer
+// BustCtx and CacheCtx, on a cache made WithContextBusting, which don't.
 func (cache *Cache) Bust(fn func()) {
+	if cache.noBusting {
+		fn()
+		return
+	}
 	atomic.AddUint32(&cache.busting, 1)                // Increment
 	defer atomic.AddUint32(&cache.busting, ^uint32(0)) // Decrement
 	fn()
 }
 
+// IsBusting reports whether it's called from within Bust (on the same goroutine),
+// so that Cache would recompute values rather than return cached ones. It
+// doesn't know about BustCtx, or keys busted by BustOnly.
+func (cache *Cache) IsBusting() bool {
+	return cache.isBusting()
+}
+
+// BustScope lets busting carry over to other goroutines. Functions passed to
+// recompute are called as if by Bust, on whichever goroutine calls it, until
+// done is called; after that they're called as they are. For example:
+//
+//	recompute, done := cache.BustScope()
+//	defer done()
+//	for _, id := range ids {
+//		go recompute(func() { loadUser(id) })
+//	}
+func (cache *Cache) BustScope() (recompute func(fn func()), done func()) {
+	var finished uint32
+	recompute = func(fn func()) {
+		if atomic.LoadUint32(&finished) != 0 {
+			fn()
+			return
+		}
+		cache.Bust(fn)
+	}
+	done = func() { atomic.StoreUint32(&finished, 1) }
+	return
+}
+
+// BustReason is the same as Bust, but records why the cache is being busted.
+// The reason is passed to the hook set by WithOnBustRecompute, for any values
+// recomputed inside the function.
+func (cache *Cache) BustReason(reason string, fn func()) {
+	pop := cache.bustReasons.push(reason)
+	defer pop()
+	cache.Bust(fn)
+}
+
+// Return the reason for the innermost bust on this goroutine, if any.
+func (cache *Cache) bustReason() string {
+	if stack := cache.bustReasons.current(); len(stack) > 0 {
+		return stack[len(stack)-1].(string)
+	}
+	return ""
+}
+
+// WithOverride calls the given function, during which any calls to Cache for
+// the given key (on the same goroutine) return the value given instead. The
+// cached value itself is left alone. This is handy for tests, or for "what if"
+// handling of a request.
+func (cache *Cache) WithOverride(key, value interface{}, fn func()) {
+	key = cache.resolve(key)
+	pop := cache.overrides.push(override{key, value})
+	defer pop()
+	fn()
+}
+
+type override struct{ key, value interface{} }
+
+// Return the innermost override of the key on this goroutine, if any.
+func (cache *Cache) overridden(key interface{}) (value interface{}, ok bool) {
+	stack := cache.overrides.current()
+	for i := len(stack) - 1; i >= 0; i-- {
+		if o := stack[i].(override); o.key == key {
+			return o.value, true
+		}
+	}
+	return nil, false
+}
+
+// BustKeys removes the values cached under the given keys, so that they're
+// recomputed next time. It's the same as calling Delete for each of them.
+func (cache *Cache) BustKeys(keys ...interface{}) {
+	for _, key := range keys {
+		cache.Delete(key)
+	}
+}
+
+// BustOnly calls the given function, during which any calls to Cache for the
+// given keys (on the same goroutine) recompute their values, like with Bust.
+// Everything else is served from the cache as usual.
+func (cache *Cache) BustOnly(keys []interface{}, fn func()) {
+	if cache.noBusting {
+		fn()
+		return
+	}
+	set := make(map[interface{}]bool, len(keys))
+	for _, key := range keys {
+		set[cache.resolve(key)] = true
+	}
+	pop := cache.bustedKeys.push(set)
+	defer pop()
+	fn()
+}
+
+// BustFuncs is the same as BustOnly, for the keys that Wrap uses for the given
+// functions. Only calls to Wrap with one of them recompute their values; any
+// other functions are served from the cache as usual.
+func (cache *Cache) BustFuncs(fns []func() interface{}, body func()) {
+	keys := make([]interface{}, len(fns))
+	for i, fn := range fns {
+		keys[i] = getFnName(fn)
+	}
+	cache.BustOnly(keys, body)
+}
+
+// Whether the key is being busted by BustOnly on this goroutine.
+func (cache *Cache) isBustedKey(key interface{}) bool {
+	for _, set := range cache.bustedKeys.current() {
+		if set.(map[interface{}]bool)[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// How many callers are currently busting. This should always be back to zero
+// once they've all returned.
+func (cache *Cache) bustingDepth() uint32 {
+	return atomic.LoadUint32(&cache.busting)
+}
+
+// ErrNilLoader is returned by CacheErr when a value needs computing, but the
+// function given is nil. Cache and Wrap panic with its message instead.
+var ErrNilLoader = errors.New("funcache: nil loader function")
+
 // Cache takes a function and caches its return value. It saves it in the store
 // under the given key. Subsequent calls to Cache, with the same key, will return
 // the cached value (if it still exists in the store), otherwise the function
 // will be called again.
+//
+// Concurrent calls with the same key share one call to the function. Calls with
+// different keys don't wait on each other; the function isn't called under any
+// lock, so a slow one only holds up callers for its own key.
+//
+// If the function panics, nothing is stored for the key, and the panic carries
+// on up to the caller. The next call for the key calls the function again. The
+// function can be nil, to only read a cached value, but Cache panics if there
+// isn't one.
 func (cache *Cache) Cache(key interface{}, fn func() interface{}) interface{} {
-	if atomic.LoadUint32(&cache.busting) == 0 || !wasCalledByCacheBustingFn() {
-		if data, ok := cache.store.Get(key); ok {
-			return data
-		}
+	value, _ := cache.cacheValue(key, fn)
+	return value
+}
+
+// CacheValue returns the value cached under the given key, if there is one, or
+// else caches the value given and returns that. Busting works the same as with
+// Cache. Since there's no function, there's no closure to allocate; but unlike
+// with Cache, the value has already been computed by the caller either way, so
+// this only suits values that are cheap to make.
+func (cache *Cache) CacheValue(key, value interface{}) interface{} {
+	key = cache.resolve(key)
+	if cached, ok := cache.get(key); ok {
+		return cache.copied(cached)
 	}
-	data := fn()
-	cache.store.Add(key, data)
-	return data
+	cache.add(key, value)
+	return cache.copied(value)
 }
 
 // Wrap caches the return value of the given function. It is the same as Cache,
 // except that it auto-assigns a cache key, which is just the function name.
+//
+// The name comes from the compiler, and can be shared by different functions:
+//   - Every value of a closure shares its name (like "pkg.main.func1"), whatever
+//     it captures, so a closure made on each call keys the same every time.
+//   - Method values share the method's name (like "pkg.(*T).Load-fm"), whatever
+//     their receiver.
+//   - Closures inside generic functions are named the same (like
+//     "pkg.Load[...].func1") for every type they're instantiated with, even
+//     though they're different code.
+//
+// Use Cache with a key of your own for the first two. WrapExact deals with the
+// last.
 func (cache *Cache) Wrap(fn func() interface{}) interface{} {
 	return cache.Cache(getFnName(fn), fn)
 }
+
+// WrapExact is the same as Wrap, except that the key is made from the function's
+// code address along with its name, so different code never shares a key, even
+// when the names match. But the same code can be compiled into several places,
+// such as when the function around a closure is inlined, so calls from
+// different places might not share a value where Wrap would. The key is only
+// good for the life of the process, unlike Wrap's.
+func (cache *Cache) WrapExact(fn func() interface{}) interface{} {
+	return cache.Cache(exactFnKey{getFnName(fn), reflect.ValueOf(fn).Pointer()}, fn)
+}
+
+type exactFnKey struct {
+	name string
+	pc   uintptr
+}
+
+// KeyForFunc returns the cache key that Wrap uses for the given function. This
+// is its fully-qualified name, as given by runtime.FuncForPC (such as
+// "github.com/you/pkg.loadUsers", or "github.com/you/pkg.main.func1" for an
+// anonymous function). It can be used to Delete what Wrap stored, for example.
+func KeyForFunc(fn func() interface{}) string {
+	return getFnName(fn)
+}
+
+// CacheLoad is the same as Cache, but also returns whether the value came from
+// the cache (a hit), or the function had to be called.
+func (cache *Cache) CacheLoad(key interface{}, fn func() interface{}) (value interface{}, hit bool) {
+	return cache.cacheValue(key, fn)
+}
+
+// WrapHit is the same as Wrap, but also returns whether the value came from the
+// cache (a hit), or the function had to be called.
+func (cache *Cache) WrapHit(fn func() interface{}) (value interface{}, hit bool) {
+	return cache.cacheValue(getFnName(fn), fn)
+}
+
+// WrapHere is the same as Wrap, except that the cache key is where it's called
+// from (its source file and line), rather than the function name. So each call
+// site gets its own value, even when they're passed the same function. Calls
+// from the same place, like in a loop, share one value.
+//
+// If WrapHere is called from a helper which is shared by several callers, they
+// all share the same key (the helper's call site). Use Cache with your own key
+// for that instead.
+func (cache *Cache) WrapHere(fn func() interface{}) interface{} {
+	return cache.Cache(getCallSite(2), fn)
+}
+
+// WrapArgs is the same as Wrap, except that the cache key is made from the
+// function name along with the given arguments, so that each set of arguments
+// gets its own value. The arguments are hashed by value, so they don't need to
+// be hashable themselves (slices and maps are fine). Pointers are keyed by what
+// they point to, not by address, so equal arguments always share a value.
+func (cache *Cache) WrapArgs(fn func() interface{}, args ...interface{}) interface{} {
+	return cache.Cache(argsKey{getFnName(fn), hashKey(args)}, fn)
+}
+
+type argsKey struct {
+	fn   string
+	args uint64
+}
+
+// Cache the function's value, returning a copy of it (if we're copying values)
+// and whether it was a hit.
+func (cache *Cache) cacheValue(key interface{}, fn func() interface{}) (value interface{}, hit bool) {
+	value, hit = cache.cacheHit(key, bustByStack, nil, fn)
+	return cache.copied(value), hit
+}
+
+// Return a copy of the value, for the caller to keep, if we've been asked to.
+func (cache *Cache) copied(value interface{}) interface{} {
+	if cache.copyOnGet != nil {
+		return cache.copyOnGet(value)
+	}
+	return value
+}
+
+// Cache the function's value, returning whether it was a hit. Any values found
+// which don't pass the check (if given) are treated as missing. The mode says
+// how to tell whether we're busting.
+func (cache *Cache) cacheHit(key interface{}, mode bustMode, check func(value interface{}) bool, fn func() interface{}) (value interface{}, hit bool) {
+	key = cache.resolve(key)
+	value, ok, busted := cache.getAs(key, mode, check)
+	if ok {
+		return value, true
+	}
+	if cache.nonBlockingHotKeys && !busted && cache.calls.inFlight(key) {
+		if value, ok := cache.stale(key, check); ok {
+			return value, true
+		}
+	}
+	if fn == nil {
+		panic(ErrNilLoader.Error())
+	}
+	return cache.load(key, fn, busted), false
+}
+
+// CacheErr caches the return value of a function that can fail. It's the same
+// as Cache, except that when the function returns an error, nothing is cached,
+// and the error is returned. The next call for the key tries again.
+//
+// The exception is ErrNotFound (or an error wrapping it), if the cache is made
+// WithNegativeTTL. That's cached for the negative TTL, and returned as the
+// error until it expires.
+func (cache *Cache) CacheErr(key interface{}, fn func() (interface{}, error)) (interface{}, error) {
+	key = cache.resolve(key)
+	if value, ok := cache.get(key); ok {
+		if isNotFound(value) {
+			return nil, value.(error)
+		}
+		return value, nil
+	}
+	if fn == nil {
+		return nil, ErrNilLoader
+	}
+	var err error
+	value := cache.compute(key, func() interface{} {
+		var value interface{}
+		value, err = fn()
+		return value
+	})
+	if err != nil {
+		if cache.negativeTTL > 0 && isNotFound(err) {
+			cache.add(key, err)
+		}
+		return nil, err
+	}
+	cache.add(key, value)
+	return value, nil
+}
+
+// WrapErr is the same as CacheErr, except that it auto-assigns a cache key,
+// which is just the function name.
+func (cache *Cache) WrapErr(fn func() (interface{}, error)) (interface{}, error) {
+	return cache.CacheErr(getFnName(fn), fn)
+}
+
+// InFlight reports whether a value for the given key is being computed right
+// now, by a call to Cache or Wrap. Callers could use this to show a spinner,
+// say, rather than waiting on the result.
+func (cache *Cache) InFlight(key interface{}) bool {
+	return cache.calls.inFlight(cache.resolve(key))
+}
+
+// CacheKeyed is the same as Cache, except that the function is passed the key
+// it's computing a value for. This saves capturing the key in a closure, and
+// lets one function serve many keys.
+func (cache *Cache) CacheKeyed(key interface{}, fn func(key interface{}) interface{}) interface{} {
+	return cache.Cache(key, func() interface{} { return fn(key) })
+}
+
+// Loader computes a value to be cached, like the functions passed to Cache. It
+// lets a loader carry its own state, such as a database handle, rather than be
+// a closure made afresh on each call.
+type Loader interface {
+	Load() interface{}
+}
+
+// LoaderFunc adapts a plain function to a Loader.
+type LoaderFunc func() interface{}
+
+// Load calls the function.
+func (fn LoaderFunc) Load() interface{} { return fn() }
+
+// CacheLoader is the same as Cache, except that the value is computed by the
+// given Loader. As with Cache, the loader can be nil, to only read a cached
+// value.
+func (cache *Cache) CacheLoader(key interface{}, l Loader) interface{} {
+	if l == nil {
+		return cache.Cache(key, nil)
+	}
+	return cache.Cache(key, l.Load)
+}
+
+// CacheView caches the return value of fn, like Cache, but returns view(value)
+// instead, on both hits and misses. This lets you cache some canonical form of
+// a value, while callers get a cheaper derived view of it. Only fn is cached;
+// view is called every time.
+func (cache *Cache) CacheView(key interface{}, fn func() interface{}, view func(cached interface{}) interface{}) interface{} {
+	return view(cache.Cache(key, fn))
+}
+
+// CacheProgress caches the return value of the function, like Cache. While it's
+// computing, the function can report partial results, which are passed on to
+// the hook given by WithOnProgress. If the value is already cached, there's no
+// progress to report.
+func (cache *Cache) CacheProgress(key interface{}, fn func(report func(partial interface{})) interface{}) interface{} {
+	return cache.Cache(key, func() interface{} {
+		return fn(func(partial interface{}) {
+			if cache.onProgress != nil {
+				cache.onProgress(key, partial)
+			}
+		})
+	})
+}
+
+// CacheFirst looks up each of the keys in turn, returning the first value
+// found. If none of them are cached, it calls the function and caches the value
+// under the first key. This is useful for cascading lookups, with the keys
+// given from most to least specific, e.g. request, tenant, global. Each call
+// counts as one hit (on the key found) or one miss (on the first key).
+func (cache *Cache) CacheFirst(keys []interface{}, fn func() interface{}) interface{} {
+	if fn == nil {
+		panic(ErrNilLoader.Error())
+	}
+	if len(keys) == 0 {
+		return fn()
+	}
+	keys = append([]interface{}(nil), keys...)
+	for i, key := range keys {
+		keys[i] = cache.resolve(key)
+	}
+	busting := cache.bustingFor(bustByStack)
+	for _, key := range keys {
+		busted := busting || cache.isBustedKey(key)
+		if value, ok := cache.probe(key, busted, nil, false); ok {
+			cache.record(key, value, true, busted)
+			return value
+		}
+	}
+	busted := busting || cache.isBustedKey(keys[0])
+	cache.record(keys[0], nil, false, busted)
+	return cache.load(keys[0], fn, busted)
+}
+
+// Increment atomically adds delta to the int64 counter cached under the given
+// key, and returns the new value. If there's no counter yet, it's seeded with
+// the value returned by initial instead. Concurrent increments of the same key
+// are safe, as long as nothing else writes to that key. Counters aren't
+// affected by busting.
+func (cache *Cache) Increment(key interface{}, delta int64, initial func() int64) int64 {
+	key = cache.resolve(key)
+	data, old, replacing := cache.increment(key, delta, initial)
+	cache.added(key, data, old, replacing) // Once unlocked, as hooks may use the key
+	return unexpire(data).(int64)
+}
+
+// Store the incremented counter for the key, holding its lock, and return what
+// was stored, like put.
+func (cache *Cache) increment(key interface{}, delta int64, initial func() int64) (data, old interface{}, replacing bool) {
+	cache.keyLocks.lock(key)
+	defer cache.keyLocks.unlock(key)
+	if data, ok := cache.store.Get(key); ok {
+		if value, ok := cache.unwrap(data); ok {
+			if n, ok := value.(int64); ok {
+				return cache.put(key, n+delta)
+			}
+		}
+	}
+	return cache.put(key, initial())
+}
+
+// Once calls the function the first time it's called for the given key, and
+// never again, even when busting. This is for side effects which should only
+// happen once, like registering a metric. It marks the key as done with an
+// entry in the store, so if the store evicts that, the function can run again.
+func (cache *Cache) Once(key interface{}, fn func()) {
+	key = onceKey{cache.resolve(key)}
+	if _, ok := cache.store.Get(key); ok {
+		return
+	}
+	cache.keyLocks.lock(key)
+	defer cache.keyLocks.unlock(key)
+	if _, ok := cache.store.Get(key); ok {
+		return
+	}
+	fn()
+	cache.add(key, struct{}{})
+}
+
+// Keys for the markers stored by Once, so they can't clash with values.
+type onceKey struct{ key interface{} }
+
+// Look up the value for the given key in the store, unless we're busting, in
+// which case it's treated as missing. Expired values are also missing, unless
+// they were computed too recently to be computed again.
+func (cache *Cache) get(key interface{}) (value interface{}, ok bool) {
+	value, ok, _ = cache.getAs(key, bustByStack, nil)
+	return
+}
+
+// Same as get, but values must also pass the given check to count as found.
+// This is for methods that store values wrapped up in their own types. Without
+// a check, values are checked against the type guard, if there is one. Also
+// returns whether we're busting, as decided by the mode (or by BustOnly).
+func (cache *Cache) getAs(key interface{}, mode bustMode, check func(value interface{}) bool) (value interface{}, ok, busted bool) {
+	return cache.find(key, mode, check, false)
+}
+
+// Same as getAs, but if mustExpire, values must also have been stored with an
+// expiry (like by CacheWithTTL) to count as found. Those without one could have
+// been put there some other way, and would never be recomputed.
+func (cache *Cache) find(key interface{}, mode bustMode, check func(value interface{}) bool, mustExpire bool) (value interface{}, ok, busted bool) {
+	busted = cache.bustingFor(mode) || cache.isBustedKey(key)
+	value, ok = cache.probe(key, busted, check, mustExpire)
+	cache.record(key, value, ok, busted)
+	return
+}
+
+// Whether lookups are busting, as decided by the mode, before any keys busted
+// by BustOnly are taken into account.
+func (cache *Cache) bustingFor(mode bustMode) bool {
+	if cache.noBusting {
+		return false
+	}
+	switch mode {
+	case bustByStack:
+		return cache.isBusting()
+	case bustAlways:
+		return true
+	}
+	return false
+}
+
+// Look up the value for the key, like find, but without counting it as a hit
+// or a miss.
+func (cache *Cache) probe(key interface{}, busted bool, check func(value interface{}) bool, mustExpire bool) (value interface{}, ok bool) {
+	if check == nil && cache.typeGuard != nil {
+		check = func(value interface{}) bool { return cache.checkType(key, value) }
+	}
+	value, ok = cache.lookup(key, busted, mustExpire)
+	if ok && check != nil && !check(value) {
+		value, ok = nil, false
+	}
+	return
+}
+
+// Count a lookup as a hit or a miss, and let the hooks know.
+func (cache *Cache) record(key, value interface{}, hit, busted bool) {
+	cache.count(key, value, hit, busted)
+	if hit && cache.onHit != nil {
+		cache.onHit(key, value)
+	} else if !hit && cache.onMiss != nil {
+		cache.onMiss(key)
+	}
+}
+
+// How a lookup decides whether it's busting.
+type bustMode int
+
+const (
+	bustByStack bustMode = iota // If called from within Bust, found by walking the stack
+	bustAlways                  // Always, e.g. for a context from BustCtx
+	bustNever                   // Never, e.g. for any other context WithContextBusting
+)
+
+func (cache *Cache) isBusting() bool {
+	return !cache.noBusting && atomic.LoadUint32(&cache.busting) != 0 && wasCalledByCacheBustingFn(cache.maxBustDepth)
+}
+
+func (cache *Cache) lookup(key interface{}, busted, mustExpire bool) (value interface{}, ok bool) {
+	if value, ok = cache.overridden(key); ok {
+		return value, true
+	}
+	if !busted {
+		if data, ok := cache.store.Get(key); ok && (!mustExpire || isExpiring(data)) {
+			if value, ok = cache.unwrap(data); ok {
+				return value, true
+			}
+		}
+	}
+	return cache.recent(key)
+}
+
+// Check that the value is of the type we're guarding for. If it's not, let the
+// hook know about it.
+func (cache *Cache) checkType(key, value interface{}) bool {
+	if isAssignable(value, cache.typeGuard) {
+		return true
+	}
+	if cache.onTypeMismatch != nil {
+		cache.onTypeMismatch(key, value)
+	}
+	return false
+}
+
+// Whether the value could be assigned to a variable of the given type.
+func isAssignable(value interface{}, t reflect.Type) bool {
+	vt := reflect.TypeOf(value)
+	if vt == nil {
+		switch t.Kind() {
+		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+			return true
+		}
+		return false
+	}
+	return vt.AssignableTo(t)
+}
+
+// Update the stats for a lookup.
+func (cache *Cache) count(key, value interface{}, hit, busted bool) {
+	if cache.countAccess {
+		cache.accessCounts.inc(key)
+	}
+	if hit && cache.trackEntries {
+		cache.entries.hit(key)
+	}
+	if !hit && busted && cache.onBustRecompute != nil {
+		cache.onBustRecompute(key, cache.bustReason())
+	}
+	if cache.metrics != nil {
+		switch {
+		case hit:
+			cache.metrics.IncHit()
+		case busted:
+			cache.metrics.IncBust()
+		default:
+			cache.metrics.IncMiss()
+		}
+	}
+	if cache.noStats {
+		return
+	}
+	switch {
+	case hit:
+		atomic.AddUint64(&cache.hits, 1)
+		if isNotFound(value) {
+			atomic.AddUint64(&cache.negativeHits, 1)
+		}
+	case busted:
+		atomic.AddUint64(&cache.busts, 1)
+	default:
+		atomic.AddUint64(&cache.misses, 1)
+	}
+}
+
+// Store the value for the given key, keeping track of when.
+func (cache *Cache) add(key, data interface{}) {
+	if data == nil && cache.noCacheNil {
+		return
+	}
+	data, old, replacing := cache.put(key, data)
+	cache.added(key, data, old, replacing)
+}
+
+// Store the data for the key, without letting the hooks know yet. Returns the
+// data as stored, and the old data it replaced (if replacing).
+func (cache *Cache) put(key, data interface{}) (stored, old interface{}, replacing bool) {
+	stored = cache.expiring(data)
+	if cache.onReplace != nil {
+		old, replacing = cache.store.Get(key)
+	}
+	cache.store.Add(key, stored)
+	return
+}
+
+// Wrap up the data to expire, if it should.
+func (cache *Cache) expiring(data interface{}) interface{} {
+	if cache.negativeTTL > 0 && isNotFound(unexpire(data)) {
+		// This replaces any TTL given for the value, e.g. by CacheWithTTL.
+		ttl := cache.negativeTTL + cache.rand.duration(cache.negativeJitter)
+		data = ttlEntry{unexpire(data), cache.clock.Now().Add(ttl)}
+	}
+	if cache.defaultTTL > 0 {
+		if _, ok := data.(ttlEntry); !ok {
+			data = ttlEntry{data, cache.clock.Now().Add(cache.defaultTTL)}
+		}
+	}
+	return data
+}
+
+// Keep track of data having been stored, and let any hooks know, including
+// about the old data it replaced (if replacing).
+func (cache *Cache) added(key, data, old interface{}, replacing bool) {
+	if cache.trackEntries {
+		cache.entries.add(key, cache.clock.Now())
+	}
+	if replacing {
+		cache.onReplace(key, unexpire(old), unexpire(data))
+	}
+	if cache.onAdd != nil {
+		cache.onAdd(key, unexpire(data))
+	}
+}
+
+// Compute and store the value for the given key. Concurrent loads of the same
+// key share a single call to the function, except when busting, in which case
+// we always make our own call.
+func (cache *Cache) load(key interface{}, fn func() interface{}, busted bool) interface{} {
+	if cache.detectCycles {
+		// Check before joining any call in flight, since that could be our own.
+		defer cache.checkCycle(key)()
+	}
+	return cache.calls.do(key, !busted, func() interface{} {
+		value := cache.call(key, fn)
+		cache.add(key, value) // Never reached if fn panics
+		return value
+	})
+}
+
+// Call the function to compute the value for the given key, watching for
+// cycles if we've been asked to.
+func (cache *Cache) compute(key interface{}, fn func() interface{}) interface{} {
+	if cache.detectCycles {
+		defer cache.checkCycle(key)()
+	}
+	return cache.call(key, fn)
+}
+
+// Call the function to compute the value for the given key.
+func (cache *Cache) call(key interface{}, fn func() interface{}) interface{} {
+	if cache.metrics != nil {
+		defer func(start time.Time) { cache.metrics.ObserveLoad(time.Since(start)) }(time.Now())
+	}
+	var start time.Time
+	if cache.timeLoads {
+		start = cache.clock.Now()
+	}
+	value := fn()
+	if cache.timeLoads {
+		cache.loadTimes.set(key, cache.clock.Now().Sub(start))
+	}
+	if cache.minRecompute > 0 {
+		cache.computedAt.set(key, cache.clock.Now())
+	}
+	return value
+}
+
+// Panic if the key is already being computed on this goroutine. Otherwise, mark
+// it as being computed, returning a func to unmark it once done.
+func (cache *Cache) checkCycle(key interface{}) (done func()) {
+	gid := getGoroutineID()
+	if !cache.computing.enter(gid, key) {
+		panic(fmt.Sprintf("funcache: cache recursion cycle on key %v", key))
+	}
+	return func() { cache.computing.exit(gid, key) }
+}
+
+// -----------------------------------------------------------------------------
+// Calls in flight, so that concurrent calls for the same key can share the
+// result of one (much like golang.org/x/sync/singleflight).
+
+type callGroup struct {
+	sync.Mutex
+	m map[interface{}]*call
+}
+
+type call struct {
+	wg    sync.WaitGroup
+	value interface{}
+	ok    bool // Whether the call returned (rather than panicking)
+}
+
+// Call fn for the key, and return its value. If join is true, and there's
+// already a call in flight for the key, wait for it and share its value
+// instead. If that call panics, we make our own.
+func (g *callGroup) do(key interface{}, join bool, fn func() interface{}) interface{} {
+	g.Lock()
+	if g.m == nil {
+		g.m = make(map[interface{}]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		g.Unlock()
+		if join {
+			c.wg.Wait()
+			if c.ok {
+				return c.value
+			}
+		}
+		return fn()
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.Unlock()
+
+	defer func() {
+		g.Lock()
+		delete(g.m, key)
+		g.Unlock()
+		c.wg.Done()
+	}()
+	c.value = fn()
+	c.ok = true
+	return c.value
+}
+
+func (g *callGroup) inFlight(key interface{}) bool {
+	g.Lock()
+	defer g.Unlock()
+	_, ok := g.m[key]
+	return ok
+}
+
+// -----------------------------------------------------------------------------
+// Mutexes for individual keys, created as needed and dropped once unused.
+
+type keyMutex struct {
+	sync.Mutex
+	m map[interface{}]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (km *keyMutex) lock(key interface{}) {
+	km.Lock()
+	if km.m == nil {
+		km.m = make(map[interface{}]*keyLock)
+	}
+	l, ok := km.m[key]
+	if !ok {
+		l = &keyLock{}
+		km.m[key] = l
+	}
+	l.refs++
+	km.Unlock()
+	l.Lock()
+}
+
+func (km *keyMutex) unlock(key interface{}) {
+	km.Lock()
+	l := km.m[key]
+	l.refs--
+	if l.refs == 0 {
+		delete(km.m, key)
+	}
+	km.Unlock()
+	l.Unlock()
+}
+
+// -----------------------------------------------------------------------------
+// Set of keys being computed by each goroutine, safe for concurrent access.
+
+type computeSet struct {
+	sync.Mutex
+	m map[uint64]map[interface{}]struct{}
+}
+
+// Add the key to the goroutine's set, returning false if it's already there.
+func (cs *computeSet) enter(gid uint64, key interface{}) bool {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.m == nil {
+		cs.m = make(map[uint64]map[interface{}]struct{})
+	}
+	keys, ok := cs.m[gid]
+	if !ok {
+		keys = make(map[interface{}]struct{})
+		cs.m[gid] = keys
+	}
+	if _, ok := keys[key]; ok {
+		return false
+	}
+	keys[key] = struct{}{}
+	return true
+}
+
+func (cs *computeSet) exit(gid uint64, key interface{}) {
+	cs.Lock()
+	defer cs.Unlock()
+	delete(cs.m[gid], key)
+	if len(cs.m[gid]) == 0 {
+		delete(cs.m, gid)
+	}
+}
@@ -1,7 +1,20 @@
 package funcache
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -29,47 +42,95 @@ func (ts *noisyTestStore) Get(key interface{}) (value interface{}, ok bool) {
 	return
 }
 
+type testClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (tc *testClock) Now() time.Time {
+	tc.Lock()
+	defer tc.Unlock()
+	return tc.now
+}
+
+func (tc *testClock) Advance(d time.Duration) {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.now = tc.now.Add(d)
+}
+
+// A clock with tickers that only tick when told to.
+type tickingTestClock struct {
+	*testClock
+	ticks chan time.Time
+}
+
+func newTickingTestClock() *tickingTestClock {
+	return &tickingTestClock{newTestClock(), make(chan time.Time)}
+}
+
+func (tc *tickingTestClock) NewTicker(d time.Duration) Ticker { return testTicker{tc.ticks} }
+
+// Advance the clock, and tick.
+func (tc *tickingTestClock) Tick(d time.Duration) {
+	tc.Advance(d)
+	tc.ticks <- tc.Now()
+}
+
+type testTicker struct{ c chan time.Time }
+
+func (tt testTicker) C() <-chan time.Time { return tt.c }
+func (tt testTicker) Stop()               {}
+
 // -----------------------------------------------------------------------------
 
-func testGetCallingFuncs() (funcNames []string) {
-	// Skip the first 3 callers:
-	// 1. runtime.Callers
-	// 2. github.com/aviddiviner/funcache.getAllCallers
-	// 3. testGetCallingFuncs (this)
-	pcs := getAllCallers(3)
-	frames := runtime.CallersFrames(pcs)
-	for {
-		frame, more := frames.Next()
-		funcNames = append(funcNames, frame.Function)
-		if !more {
-			break
-		}
-	}
-	return
+func TestCacheBustingFnName(t *testing.T) {
+	assert.Equal(t, cacheBustingFn, runtime.FuncForPC(cacheBustingFnPc).Name())
+}
+
+// Where this was called from.
+func testGetCallSite() string {
+	return getCallSite(2)
 }
 
 func TestCaller(t *testing.T) {
-	fns := testGetCallingFuncs()
-	var found bool
-	for _, fn := range fns {
-		if fn == "github.com/aviddiviner/go-funcache.TestCaller" {
-			found = true
-		}
-	}
-	assert.True(t, found)
+	_, file, line, _ := runtime.Caller(0)
+	assert.Equal(t, file+":"+strconv.Itoa(line+1), testGetCallSite())
 
 	cache := nilCache()
 	cache.Bust(func() {
-		assert.True(t, wasCalledByCacheBustingFn())
+		assert.True(t, wasCalledByCacheBustingFn(0))
+		assert.True(t, wasCalledByCacheBustingFn(10))
+		assert.False(t, wasCalledByCacheBustingFn(1))
 	})
 }
 
+func TestIsBusting(t *testing.T) {
+	cache, other := nilCache(), nilCache()
+	assert.False(t, cache.IsBusting())
+	cache.Bust(func() {
+		assert.True(t, cache.IsBusting())
+		assert.False(t, other.IsBusting())
+		done := make(chan bool)
+		go func() {
+			assert.False(t, cache.IsBusting()) // Not on other goroutines
+			done <- true
+		}()
+		<-done
+	})
+	assert.False(t, cache.IsBusting())
+}
+
 func TestWrapIsDistinct(t *testing.T) {
 	cache := nilCache()
 
 	getValueA := func() (value, caller string) {
 		value = cache.Wrap(func() interface{} {
-			caller = testGetCallingFuncs()[0]
+			caller = testGetCallSite()
 			return "A"
 		}).(string)
 		return
@@ -84,55 +145,3042 @@ func TestWrapIsDistinct(t *testing.T) {
 
 	var callerB string
 	valueB := cache.Wrap(func() interface{} {
-		callerB = testGetCallingFuncs()[0]
+		callerB = testGetCallSite()
 		return "B"
 	})
-	assert.Equal(t, "B", valueB)
+	assert.Equal(t, "B", valueB)
+
+	assert.NotEqual(t, callerA, callerB)
+}
+
+func TestWrapHit(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	var callCount int
+	foo := func() interface{} {
+		callCount += 1
+		return "Foo!"
+	}
+
+	value, hit := cache.WrapHit(foo)
+	assert.Equal(t, "Foo!", value)
+	assert.False(t, hit)
+
+	value, hit = cache.WrapHit(foo)
+	assert.Equal(t, "Foo!", value)
+	assert.True(t, hit)
+	assert.Equal(t, 1, callCount)
+
+	cache.Bust(func() {
+		value, hit = cache.WrapHit(foo)
+		assert.Equal(t, "Foo!", value)
+		assert.False(t, hit)
+		assert.Equal(t, 2, callCount)
+	})
+
+	// Same key as Wrap.
+	assert.Equal(t, "Foo!", cache.Wrap(foo))
+	assert.Equal(t, 2, callCount)
+}
+
+func TestBasics(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	var callCount int
+	getFoo := func() string {
+		return cache.Wrap(func() interface{} {
+			callCount += 1
+			return "Foo!"
+		}).(string)
+	}
+
+	assert.Equal(t, "Foo!", getFoo())
+	assert.Equal(t, 1, callCount)
+
+	assert.Equal(t, "Foo!", getFoo())
+	assert.Equal(t, 1, callCount)
+
+	cache.Bust(func() {
+		assert.Equal(t, "Foo!", getFoo())
+		assert.Equal(t, 2, callCount)
+
+		assert.Equal(t, "Foo!", getFoo())
+		assert.Equal(t, 3, callCount)
+	})
+}
+
+func withTestTimeout(t *testing.T, millis int, fn func()) {
+	done := make(chan bool)
+	go func() {
+		fn()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(millis) * time.Millisecond):
+		t.Fatal("timed out")
+	}
+}
+
+func TestFibonacci(t *testing.T) {
+	cache := NewInMemCache()
+	var fib func(k int) int
+	fib = func(k int) int {
+		if k < 2 {
+			return k
+		}
+		a := cache.Cache(k-1, func() interface{} { return fib(k - 1) })
+		b := cache.Cache(k-2, func() interface{} { return fib(k - 2) })
+		return a.(int) + b.(int)
+	}
+	withTestTimeout(t, 500, func() { fib(36) }) // Retardedly slow without caching
+}
+
+func testCacheUse(t *testing.T, cache *Cache, key, val interface{}, bust bool) {
+	var gotBust bool
+	gotVal := cache.Cache(key, func() interface{} {
+		gotBust = true
+		return val
+	})
+	assert.Equal(t, val, gotVal)
+	assert.Equal(t, bust, gotBust)
+}
+
+// Same as testCacheUse, but checks the hit flag from CacheLoad instead.
+func testCacheLoad(t *testing.T, cache *Cache, key, val interface{}, wantHit bool) {
+	gotVal, gotHit := cache.CacheLoad(key, func() interface{} { return val })
+	assert.Equal(t, val, gotVal)
+	assert.Equal(t, wantHit, gotHit)
+}
+
+func TestCacheLoad(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	testCacheLoad(t, cache, "foo", "Foo!", false)
+	testCacheLoad(t, cache, "foo", "Foo!", true)
+	testCacheLoad(t, cache, "bar", "Bar!", false)
+	testCacheLoad(t, cache, "foo", "Foo!", true)
+
+	cache.Bust(func() {
+		testCacheLoad(t, cache, "foo", "Foo!", false)
+		testCacheLoad(t, cache, "bar", "Bar!", false)
+	})
+	testCacheLoad(t, cache, "bar", "Bar!", true)
+}
+
+func TestNestedCachingAndBusting(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	var callCount int
+	getFoo := func() interface{} {
+		return cache.Wrap(func() interface{} {
+			callCount += 1
+			return "Foo!"
+		})
+	}
+	getBar := func() interface{} {
+		return cache.Wrap(func() interface{} {
+			getFoo()
+			getFoo()
+			callCount += 1
+			return "Bar!"
+		})
+	}
+
+	assert.Equal(t, "Foo!", getFoo())
+	assert.Equal(t, 1, callCount)
+
+	assert.Equal(t, "Bar!", getBar())
+	assert.Equal(t, 2, callCount)
+
+	cache.Bust(func() {
+		assert.Equal(t, "Foo!", getFoo())
+		assert.Equal(t, 3, callCount)
+
+		assert.Equal(t, "Bar!", getBar())
+		assert.Equal(t, 6, callCount)
+
+		func() {
+			assert.Equal(t, "Bar!", getBar())
+			assert.Equal(t, 9, callCount)
+		}()
+
+		cache.Bust(func() {
+			assert.Equal(t, "Bar!", getBar())
+			assert.Equal(t, 12, callCount)
+		})
+	})
+
+	assert.Equal(t, "Bar!", getBar())
+	assert.Equal(t, 12, callCount)
+}
+
+func TestDeleteAndClear(t *testing.T) {
+	lruStore, err := lru.New2Q(10)
+	assert.NoError(t, err)
+	var _ PurgeableStore = lruStore  // The LRU stores already have Remove
+	var _ RemovableStore = lruStore  // and Purge, so they work as they are.
+	var _ EnumerableStore = lruStore // They can list their Keys, too.
+
+	for _, cache := range []*Cache{NewInMemCache(), New(newCopyOnWriteMap()), NewSyncMapCache(), New(lruStore)} {
+		testCacheUse(t, cache, "foo", "Foo!", true)
+		testCacheUse(t, cache, "bar", "Bar!", true)
+
+		cache.Delete("foo")
+		cache.Delete("nope")
+		testCacheUse(t, cache, "foo", "Foo!", true)
+		testCacheUse(t, cache, "bar", "Bar!", false)
+
+		cache.Clear()
+		testCacheUse(t, cache, "foo", "Foo!", true)
+		testCacheUse(t, cache, "bar", "Bar!", true)
+	}
+
+	// Stores that can't remove keys are left as they are.
+	cache := noisyTestCache(t)
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	cache.Delete("foo")
+	cache.Clear()
+	testCacheUse(t, cache, "foo", "Foo!", false)
+}
+
+func TestBustScope(t *testing.T) {
+	cache := NewInMemCache()
+
+	var callCount int32
+	getFoo := func() interface{} {
+		return cache.Cache("foo", func() interface{} {
+			return atomic.AddInt32(&callCount, 1)
+		})
+	}
+	inGoroutine := func(fn func()) {
+		done := make(chan bool)
+		go func() {
+			fn()
+			done <- true
+		}()
+		<-done
+	}
+
+	assert.Equal(t, int32(1), getFoo())
+
+	// Goroutines started inside Bust don't bust on their own.
+	cache.Bust(func() {
+		inGoroutine(func() { assert.Equal(t, int32(1), getFoo()) })
+	})
+
+	recompute, done := cache.BustScope()
+	cache.Bust(func() {
+		inGoroutine(func() {
+			recompute(func() { assert.Equal(t, int32(2), getFoo()) })
+		})
+	})
+	done()
+	inGoroutine(func() {
+		recompute(func() { assert.Equal(t, int32(2), getFoo()) })
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+}
+
+func TestNamespace(t *testing.T) {
+	cache := NewInMemCache()
+	users, orders := cache.Namespace("users"), cache.Namespace("orders")
+
+	testCacheUse(t, users, "1", "Alice", true)
+	testCacheUse(t, orders, "1", "Order #1", true)
+	testCacheUse(t, users, 2, "Bob", true)
+	testCacheUse(t, orders, 2, "Order #2", true)
+	testCacheUse(t, cache, "1", "Root", true)
+
+	testCacheUse(t, users, "1", "Alice", false)
+	testCacheUse(t, orders, "1", "Order #1", false)
+	testCacheUse(t, users, 2, "Bob", false)
+	testCacheUse(t, orders, 2, "Order #2", false)
+	testCacheUse(t, cache, "users/1", "Alice", false)
+
+	// Stats and busting are shared.
+	assert.Equal(t, Stats{Hits: 5, Misses: 5}, users.Stats())
+	cache.Bust(func() {
+		testCacheUse(t, users, "1", "Alice", true)
+	})
+	users.Bust(func() {
+		testCacheUse(t, orders, "1", "Order #1", true)
+	})
+
+	// Deleting and clearing stay within the namespace.
+	users.Delete("1")
+	users.BustKeys(2)
+	testCacheUse(t, orders, "1", "Order #1", false)
+	testCacheUse(t, orders, 2, "Order #2", false)
+	testCacheUse(t, users, "1", "Alice", true)
+	testCacheUse(t, users, 2, "Bob", true)
+
+	nested := orders.Namespace("archived")
+	testCacheUse(t, nested, "1", "Old order", true)
+	orders.Clear()
+	assert.Equal(t, 3, cache.Len())
+	testCacheUse(t, users, "1", "Alice", false)
+	testCacheUse(t, nested, "1", "Old order", true)
+	testCacheUse(t, orders, "1", "Order #1", true)
+}
+
+func TestBustKeys(t *testing.T) {
+	cache := NewInMemCache()
+	for _, key := range []string{"foo", "bar", "baz"} {
+		testCacheUse(t, cache, key, key, true)
+	}
+
+	cache.BustKeys("foo", "bar")
+	testCacheUse(t, cache, "foo", "foo", true)
+	testCacheUse(t, cache, "bar", "bar", true)
+	testCacheUse(t, cache, "baz", "baz", false)
+}
+
+func TestBustWhere(t *testing.T) {
+	cache := New(newSyncMap())
+	for _, key := range []string{"tenant:42:profile", "tenant:42:prefs", "tenant:7:profile", "global"} {
+		testCacheUse(t, cache, key, key, true)
+	}
+
+	isTenant42 := func(key interface{}) bool {
+		s, ok := key.(string)
+		return ok && strings.HasPrefix(s, "tenant:42:")
+	}
+	assert.Equal(t, 2, cache.BustWhere(isTenant42))
+	assert.Equal(t, 0, cache.BustWhere(isTenant42))
+	assert.ElementsMatch(t, []interface{}{"tenant:7:profile", "global"}, cache.Keys())
+
+	// In a namespace, keys are matched without their prefix.
+	users := cache.Namespace("users")
+	testCacheUse(t, users, "tenant:42:profile", "Alice", true)
+	assert.Equal(t, 1, users.BustWhere(isTenant42))
+	assert.Len(t, cache.Keys(), 2)
+
+	assert.Equal(t, 0, noisyTestCache(t).BustWhere(isTenant42)) // Can't enumerate
+}
+
+func TestBustOnly(t *testing.T) {
+	cache := NewInMemCache()
+	for _, key := range []string{"foo", "bar", "baz"} {
+		testCacheUse(t, cache, key, key, true)
+	}
+
+	cache.BustOnly([]interface{}{"foo", "bar"}, func() {
+		testCacheUse(t, cache, "foo", "foo", true)
+		testCacheUse(t, cache, "baz", "baz", false)
+		cache.BustOnly([]interface{}{"baz"}, func() {
+			testCacheUse(t, cache, "bar", "bar", true)
+			testCacheUse(t, cache, "baz", "baz", true)
+		})
+		testCacheUse(t, cache, "baz", "baz", false)
+	})
+	testCacheUse(t, cache, "foo", "foo", false)
+	testCacheUse(t, cache, "bar", "bar", false)
+	testCacheUse(t, cache, "baz", "baz", false)
+}
+
+func TestBustFuncs(t *testing.T) {
+	cache := NewInMemCache()
+	calls := make(map[string]int)
+	users := func() interface{} { calls["users"]++; return "Users" }
+	groups := func() interface{} { calls["groups"]++; return "Groups" }
+	perms := func() interface{} { calls["perms"]++; return "Perms" }
+	wrapAll := func() {
+		assert.Equal(t, "Users", cache.Wrap(users))
+		assert.Equal(t, "Groups", cache.Wrap(groups))
+		assert.Equal(t, "Perms", cache.Wrap(perms))
+	}
+
+	wrapAll()
+	cache.BustFuncs([]func() interface{}{users, perms}, wrapAll)
+	assert.Equal(t, map[string]int{"users": 2, "groups": 1, "perms": 2}, calls)
+	wrapAll()
+	assert.Equal(t, map[string]int{"users": 2, "groups": 1, "perms": 2}, calls)
+}
+
+func TestBustCtx(t *testing.T) {
+	cache := NewInMemCache()
+	other := NewInMemCache()
+
+	var callCount int32
+	getFoo := func(ctx context.Context) interface{} {
+		return cache.CacheCtx(ctx, "foo", func(ctx context.Context) interface{} {
+			atomic.AddInt32(&callCount, 1)
+			return "Foo!"
+		})
+	}
+	getBar := func(ctx context.Context) interface{} {
+		return other.CacheCtx(ctx, "bar", func(ctx context.Context) interface{} {
+			atomic.AddInt32(&callCount, 1)
+			return "Bar!"
+		})
+	}
+
+	ctx := context.Background()
+	assert.Equal(t, "Foo!", getFoo(ctx))
+	assert.Equal(t, "Bar!", getBar(ctx))
+	assert.Equal(t, "Foo!", getFoo(ctx))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+
+	cache.BustCtx(ctx, func(ctx context.Context) {
+		// Busting carries across goroutines, with the context.
+		done := make(chan bool)
+		go func() {
+			assert.Equal(t, "Foo!", getFoo(ctx))
+			done <- true
+		}()
+		<-done
+		assert.Equal(t, int32(3), atomic.LoadInt32(&callCount))
+
+		// But only for the cache being busted.
+		assert.Equal(t, "Bar!", getBar(ctx))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&callCount))
+	})
+
+	assert.Equal(t, "Foo!", getFoo(ctx))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&callCount))
+
+	// A plain Bust still works too.
+	cache.Bust(func() {
+		assert.Equal(t, "Foo!", getFoo(ctx))
+	})
+	assert.Equal(t, int32(4), atomic.LoadInt32(&callCount))
+}
+
+func TestWithContextBusting(t *testing.T) {
+	cache := NewInMemCache(WithContextBusting())
+	ctx := context.Background()
+
+	var callCount int32
+	getFoo := func(ctx context.Context) interface{} {
+		return cache.CacheCtx(ctx, "foo", func(ctx context.Context) interface{} {
+			atomic.AddInt32(&callCount, 1)
+			return "Foo!"
+		})
+	}
+	assert.Equal(t, "Foo!", getFoo(ctx))
+	cache.BustCtx(ctx, func(ctx context.Context) {
+		assert.Equal(t, "Foo!", getFoo(ctx))
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+
+	// A plain Bust doesn't reach the context, but still busts Cache.
+	cache.Bust(func() {
+		assert.Equal(t, "Foo!", getFoo(ctx))
+		testCacheUse(t, cache, "bar", "Bar!", true)
+		testCacheUse(t, cache, "bar", "Bar!", true)
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+}
+
+func TestCacheContext(t *testing.T) {
+	cache := NewInMemCache()
+
+	// Cancelling the only caller cancels the load, and nothing is cached.
+	started, finished := make(chan bool), make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := cache.CacheContext(ctx, "foo", func(ctx context.Context) (interface{}, error) {
+		started <- true
+		<-ctx.Done()
+		defer close(finished)
+		return "Foo!", nil // Ignoring the cancellation
+	})
+	assert.Equal(t, context.Canceled, err)
+	<-finished
+	assert.Equal(t, 0, cache.Len())
+
+	// As long as one caller is still waiting, the load carries on.
+	started, release := make(chan bool), make(chan bool)
+	load := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		select {
+		case <-release:
+			return "Foo!", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	result := make(chan interface{})
+	go func() {
+		value, err := cache.CacheContext(context.Background(), "foo", load)
+		assert.NoError(t, err)
+		result <- value
+	}()
+	<-started
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = cache.CacheContext(ctx, "foo", load)
+	assert.Equal(t, context.Canceled, err)
+	close(release)
+	assert.Equal(t, "Foo!", <-result)
+
+	value, err := cache.CacheContext(ctx, "foo", load) // Hits, even though ctx is done
+	assert.NoError(t, err)
+	assert.Equal(t, "Foo!", value)
+
+	// Deadlines are respected, and errors aren't cached.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = cache.CacheContext(ctx, "bar", func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = cache.CacheContext(context.Background(), "bar", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("unavailable")
+	})
+	assert.EqualError(t, err, "unavailable")
+	assert.Equal(t, 1, cache.Len())
+
+	// Panics are passed on to the caller.
+	assert.PanicsWithValue(t, "boom", func() {
+		cache.CacheContext(context.Background(), "baz", func(ctx context.Context) (interface{}, error) {
+			panic("boom")
+		})
+	})
+}
+
+func TestCacheErr(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	var callCount int
+	var loadErr error
+	load := func() (interface{}, error) {
+		callCount += 1
+		if loadErr != nil {
+			return "Partial!", loadErr
+		}
+		return "Foo!", nil
+	}
+
+	loadErr = errors.New("unavailable")
+	value, err := cache.CacheErr("foo", load)
+	assert.Equal(t, loadErr, err)
+	assert.Nil(t, value)
+	_, ok := cache.get("foo")
+	assert.False(t, ok) // Still a miss
+
+	loadErr = nil
+	value, err = cache.CacheErr("foo", load)
+	assert.NoError(t, err)
+	assert.Equal(t, "Foo!", value)
+	value, err = cache.CacheErr("foo", load)
+	assert.NoError(t, err)
+	assert.Equal(t, "Foo!", value)
+	assert.Equal(t, 2, callCount)
+
+	loadErr = errors.New("unavailable")
+	_, err = cache.WrapErr(load)
+	assert.Equal(t, loadErr, err)
+	loadErr = nil
+	value, _ = cache.WrapErr(load)
+	assert.Equal(t, "Foo!", value)
+	value, _ = cache.WrapErr(load)
+	assert.Equal(t, "Foo!", value)
+	assert.Equal(t, 4, callCount)
+}
+
+func TestPanicsAreNotCached(t *testing.T) {
+	store := &noisyTestStore{t: t, m: make(map[interface{}]interface{})}
+	cache := New(store)
+
+	var callCount int
+	flaky := func() interface{} {
+		callCount += 1
+		if callCount == 1 {
+			panic("transient")
+		}
+		return "Foo!"
+	}
+
+	assert.PanicsWithValue(t, "transient", func() { cache.Cache("foo", flaky) })
+	assert.Empty(t, store.m)
+
+	assert.Equal(t, "Foo!", cache.Cache("foo", flaky))
+	assert.Equal(t, "Foo!", cache.Cache("foo", flaky))
+	assert.Equal(t, 2, callCount)
+
+	callCount = 0
+	assert.PanicsWithValue(t, "transient", func() { cache.Wrap(flaky) })
+	assert.Equal(t, "Foo!", cache.Wrap(flaky))
+	assert.Equal(t, "Foo!", cache.Wrap(flaky))
+	assert.Equal(t, 2, callCount)
+}
+
+func TestWrapHere(t *testing.T) {
+	cache := NewInMemCache()
+
+	var callCount int
+	counter := func() interface{} {
+		callCount += 1
+		return callCount
+	}
+
+	// Two call sites, same function: separate values.
+	assert.Equal(t, 1, cache.WrapHere(counter))
+	assert.Equal(t, 2, cache.WrapHere(counter))
+
+	// One call site, in a loop: the same value each time.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 3, cache.WrapHere(counter))
+	}
+	assert.Equal(t, 3, callCount)
+
+	entries := cache.Export()
+	assert.Len(t, entries, 3)
+	for _, entry := range entries {
+		assert.Contains(t, entry.Key, "funcache_test.go:")
+	}
+}
+
+func TestWrapArgs(t *testing.T) {
+	cache := NewInMemCache()
+
+	var callCount int
+	getUser := func(id int, tags []string) interface{} {
+		return cache.WrapArgs(func() interface{} {
+			callCount += 1
+			return fmt.Sprintf("user %d %v", id, tags)
+		}, id, tags)
+	}
+
+	assert.Equal(t, "user 1 [a]", getUser(1, []string{"a"}))
+	assert.Equal(t, "user 2 [a]", getUser(2, []string{"a"}))
+	assert.Equal(t, "user 1 [b]", getUser(1, []string{"b"}))
+	assert.Equal(t, 3, callCount)
+
+	assert.Equal(t, "user 1 [a]", getUser(1, []string{"a"}))
+	assert.Equal(t, "user 2 [a]", getUser(2, []string{"a"}))
+	assert.Equal(t, 3, callCount)
+
+	// Maps are fine as arguments too, and key the same regardless of order.
+	m1 := map[string]int{"x": 1, "y": 2}
+	m2 := map[string]int{"y": 2, "x": 1}
+	fn := func() interface{} { callCount += 1; return "map" }
+	cache.WrapArgs(fn, m1)
+	cache.WrapArgs(fn, m2)
+	assert.Equal(t, 4, callCount)
+
+	// And pointers key by what they point to.
+	cache.WrapArgs(fn, &hashTestNode{Name: "a"})
+	cache.WrapArgs(fn, &hashTestNode{Name: "a"})
+	assert.Equal(t, 5, callCount)
+}
+
+func TestUnhashableKeys(t *testing.T) {
+	for _, cache := range []*Cache{NewInMemCache(), New(newCopyOnWriteMap()), NewSyncMapCache(), NewInMemCache(WithAccessCounting())} {
+		testCacheUse(t, cache, []int{1, 2}, "One, two!", true)
+		testCacheUse(t, cache, []int{1, 2}, "One, two!", false)
+		testCacheUse(t, cache, []int{2, 1}, "Two, one!", true)
+		testCacheUse(t, cache, map[string]int{"a": 1}, "A!", true)
+		testCacheUse(t, cache, map[string]int{"a": 1}, "A!", false)
+
+		cache.Delete([]int{1, 2})
+		testCacheUse(t, cache, []int{1, 2}, "One, two!", true)
+
+		// Even when the type is comparable, but the value held isn't.
+		testCacheUse(t, cache, struct{ A interface{} }{[]int{1}}, "Struct!", true)
+		testCacheUse(t, cache, struct{ A interface{} }{[]int{1}}, "Struct!", false)
+		testCacheUse(t, cache, [1]interface{}{[]int{1}}, "Array!", true)
+		testCacheUse(t, cache, [1]interface{}{[]int{1}}, "Array!", false)
+		testCacheUse(t, cache, struct{ A interface{} }{1}, "One!", true)
+	}
+
+	// The built-in stores can be used directly with them, too.
+	for _, store := range []RemovableStore{newSyncMap(), newCopyOnWriteMap(), newConcurrentMap()} {
+		store.Add([]string{"x"}, "X!")
+		value, ok := store.Get([]string{"x"})
+		assert.True(t, ok)
+		assert.Equal(t, "X!", value)
+		store.Remove([]string{"x"})
+		_, ok = store.Get([]string{"x"})
+		assert.False(t, ok)
+	}
+}
+
+type hashTestNode struct {
+	Name     string
+	Tags     map[string]int
+	Children []*hashTestNode
+	parent   *hashTestNode
+}
+
+func TestHashKey(t *testing.T) {
+	newTree := func(tags ...string) *hashTestNode {
+		root := &hashTestNode{Name: "root", Tags: make(map[string]int)}
+		for i, tag := range tags {
+			root.Tags[tag] = i % 2
+		}
+		root.Children = []*hashTestNode{{Name: "a", parent: root}, {Name: "b", parent: root}}
+		return root
+	}
+
+	// Equal values hash equal, whatever their addresses, or the order their
+	// maps were filled in.
+	assert.Equal(t, hashKey(newTree("x", "y", "z")), hashKey(newTree("x", "y", "z")))
+	assert.Equal(t, hashKey(*newTree("x", "y", "z")), hashKey(*newTree("x", "y", "z")))
+	assert.Equal(t, hashKey(map[string]int{"x": 1, "y": 2}), hashKey(map[string]int{"y": 2, "x": 1}))
+	assert.Equal(t, hashKey([]interface{}{1, "a", []int{2}}), hashKey([]interface{}{1, "a", []int{2}}))
+
+	// Unequal values don't.
+	distinct := []interface{}{
+		nil, 0, int64(0), uint(0), 0.0, "", false,
+		1, int64(1), "1", 1.5, true,
+		[]int(nil), []int{}, []int{1}, []int{1, 2}, []int{2, 1}, [2]int{1, 2},
+		[]string{"ab", "c"}, []string{"a", "bc"},
+		map[string]int{}, map[string]int{"x": 1}, map[string]int{"x": 2}, map[string]int{"y": 1},
+		map[string]int{"x": 1, "y": 2}, map[string]int{"x": 2, "y": 1},
+		[]interface{}{1, "a"}, []interface{}{"a", 1}, []interface{}{int64(1), "a"},
+		*newTree("x", "y"), *newTree("y", "x"), *newTree("x", "y", "z"), newTree("x", "y"),
+		(*hashTestNode)(nil), &hashTestNode{}, hashTestNode{},
+	}
+	hashes := make(map[uint64]interface{})
+	for _, v := range distinct {
+		h := hashKey(v)
+		if other, ok := hashes[h]; ok {
+			t.Errorf("%#v hashes the same as %#v", v, other)
+		}
+		hashes[h] = v
+	}
+
+	// Keys holding types are fine, and hash by the type.
+	assert.Equal(t, HashKey(StructKey(testKeyedRequest{UserID: 1})), HashKey(StructKey(testKeyedRequest{UserID: 1})))
+	assert.NotEqual(t, HashKey(StructKey(testKeyedRequest{UserID: 1})), HashKey(StructKey(testKeyedRequest{UserID: 2})))
+	assert.NotEqual(t, HashKey(normalizeKey([]int{1})), HashKey(normalizeKey([]uint{1})))
+
+	// Cycles, through pointers or maps, are fine.
+	loop := map[string]interface{}{"x": 1}
+	loop["self"] = loop
+	assert.Equal(t, hashKey(loop), hashKey(loop))
+}
+
+func TestCopyOnWriteMapConcurrentWrites(t *testing.T) {
+	store := newCopyOnWriteMap()
+	const numWriters, numKeys = 20, 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for k := 0; k < numKeys; k++ {
+				store.Add([2]int{w, k}, k)
+				if k%10 == 0 {
+					store.Remove([2]int{w, k}) // Mixed in with others' writes
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Nothing was lost, or removed that shouldn't have been.
+	assert.Equal(t, numWriters*numKeys*9/10, store.Len())
+	for w := 0; w < numWriters; w++ {
+		for k := 0; k < numKeys; k++ {
+			value, ok := store.Get([2]int{w, k})
+			if k%10 == 0 {
+				assert.False(t, ok)
+			} else if assert.True(t, ok) {
+				assert.Equal(t, k, value)
+			}
+		}
+	}
+	assert.Empty(t, store.pending)
+}
+
+func TestNilLoader(t *testing.T) {
+	cache := NewInMemCache()
+	assert.PanicsWithValue(t, "funcache: nil loader function", func() { cache.Cache("foo", nil) })
+	assert.PanicsWithValue(t, "funcache: nil loader function", func() { cache.Wrap(nil) })
+	_, err := cache.CacheErr("foo", nil)
+	assert.Equal(t, ErrNilLoader, err)
+
+	// It's fine to only read a value that's there.
+	cache.Set("foo", "Foo!")
+	assert.Equal(t, "Foo!", cache.Cache("foo", nil))
+	value, err := cache.CacheErr("foo", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "Foo!", value)
+}
+
+func TestGetFnName(t *testing.T) {
+	foo := func() interface{} { return "Foo!" }
+	bar := func() interface{} { return "Bar!" }
+
+	fooName, barName := getFnName(foo), getFnName(bar)
+	assert.NotEqual(t, fooName, barName)
+	assert.Equal(t, fooName, getFnName(foo)) // Cached
+	assert.Equal(t, barName, getFnName(bar))
+	assert.Equal(t, lookupFnName(reflect.ValueOf(foo).Pointer()), fooName)
+	assert.Contains(t, fooName, "TestGetFnName")
+}
+
+func TestKeyForFunc(t *testing.T) {
+	cache := NewInMemCache()
+	var callCount int
+	foo := func() interface{} {
+		callCount++
+		return "Foo!"
+	}
+
+	assert.Equal(t, "Foo!", cache.Wrap(foo))
+	assert.Equal(t, "Foo!", cache.Cache(KeyForFunc(foo), foo))
+	assert.Equal(t, 1, callCount)
+
+	cache.Delete(KeyForFunc(foo))
+	assert.Equal(t, "Foo!", cache.Wrap(foo))
+	assert.Equal(t, 2, callCount)
+	assert.Equal(t, "github.com/aviddiviner/go-funcache.TestKeyForFunc.func1", KeyForFunc(foo))
+}
+
+func TestBackedByAnotherStore(t *testing.T) {
+	store, err := lru.New2Q(10)
+	assert.NoError(t, err)
+	cache := New(store)
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	testCacheUse(t, cache, "bar", "Bar!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+
+	cache.Bust(func() {
+		testCacheUse(t, cache, "bar", "Bar!", true)
+		testCacheUse(t, cache, "foo", "Foo!", true)
+	})
+
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	testCacheUse(t, cache, "bar", "Bar!", false)
+}
+
+func TestInFlight(t *testing.T) {
+	cache := NewInMemCache()
+	assert.False(t, cache.InFlight("slow"))
+
+	started, release := make(chan bool, 5), make(chan bool)
+	var wg sync.WaitGroup
+	var callCount int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "Slow!", cache.Cache("slow", func() interface{} {
+				atomic.AddInt32(&callCount, 1)
+				started <- true
+				<-release
+				return "Slow!"
+			}))
+		}()
+	}
+
+	<-started
+	assert.True(t, cache.InFlight("slow"))
+	assert.False(t, cache.InFlight("other"))
+	close(release)
+	wg.Wait()
+
+	assert.False(t, cache.InFlight("slow"))
+	assert.True(t, atomic.LoadInt32(&callCount) >= 1)
+}
+
+func TestNonBlockingHotKeys(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock), WithNonBlockingHotKeys())
+
+	cache.CacheTTLFunc("hot", func() interface{} { return "Old!" }, func(interface{}) time.Duration {
+		return time.Second
+	})
+	clock.Advance(2 * time.Second) // Expired, but still stored
+
+	started, release := make(chan bool), make(chan bool)
+	done := make(chan interface{})
+	go func() {
+		done <- cache.Cache("hot", func() interface{} {
+			started <- true
+			<-release
+			return "New!"
+		})
+	}()
+	<-started
+
+	withTestTimeout(t, 1000, func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.Equal(t, "Old!", cache.Cache("hot", func() interface{} {
+					t.Error("shouldn't recompute while in flight")
+					return nil
+				}))
+			}()
+		}
+		wg.Wait()
+	})
+
+	close(release)
+	assert.Equal(t, "New!", <-done)
+	assert.Equal(t, "New!", cache.Cache("hot", nil))
+}
+
+func TestSetAndGetIfPresent(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	_, ok := cache.GetIfPresent("foo")
+	assert.False(t, ok)
+
+	cache.Set("foo", "Foo!")
+	value, ok := cache.GetIfPresent("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "Foo!", value)
+	testCacheUse(t, cache, "foo", "Foo!", false) // Warmed, so no need to compute
+
+	cache.Bust(func() {
+		value, ok := cache.GetIfPresent("foo") // Just a read, even when busting
+		assert.True(t, ok)
+		assert.Equal(t, "Foo!", value)
+	})
+	assert.Equal(t, Stats{Hits: 1}, cache.Stats())
+}
+
+func TestWithCopyOnGet(t *testing.T) {
+	copyInts := func(value interface{}) interface{} {
+		return append([]int(nil), value.([]int)...)
+	}
+	cache := NewInMemCache(WithCopyOnGet(copyInts))
+	load := func() interface{} { return []int{1, 2, 3} }
+
+	first := cache.Cache("nums", load).([]int)
+	first[0] = 100 // Doesn't change what's cached
+	second := cache.Cache("nums", load).([]int)
+	assert.Equal(t, []int{1, 2, 3}, second)
+	second[1] = 200
+	value, ok := cache.GetIfPresent("nums")
+	assert.True(t, ok)
+	assert.Equal(t, []int{1, 2, 3}, value)
+
+	// Without it, everyone shares the one slice.
+	cache = NewInMemCache()
+	cache.Cache("nums", load).([]int)[0] = 100
+	assert.Equal(t, []int{100, 2, 3}, cache.Cache("nums", load))
+}
+
+func TestCacheValue(t *testing.T) {
+	cache := noisyTestCache(t)
+	assert.Equal(t, "Foo!", cache.CacheValue("foo", "Foo!"))
+	assert.Equal(t, "Foo!", cache.CacheValue("foo", "Other!")) // Already cached
+	testCacheUse(t, cache, "foo", "Foo!", false)
+
+	cache.Bust(func() {
+		assert.Equal(t, "New!", cache.CacheValue("foo", "New!"))
+	})
+	assert.Equal(t, "New!", cache.CacheValue("foo", "Other!"))
+	assert.Equal(t, Stats{Hits: 3, Misses: 1, Busts: 1}, cache.Stats())
+}
+
+func TestAsKV(t *testing.T) {
+	cache := NewInMemCache()
+	kv := cache.AsKV()
+
+	_, ok := kv.Get("foo")
+	assert.False(t, ok)
+
+	kv.Set("foo", "Foo!")
+	value, ok := kv.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "Foo!", value)
+
+	// The cache and its KV view share the same values.
+	assert.Equal(t, "Foo!", cache.Cache("foo", nil))
+	cache.Cache("bar", func() interface{} { return "Bar!" })
+	value, _ = kv.Get("bar")
+	assert.Equal(t, "Bar!", value)
+}
+
+func TestConcurrentMissesShareOneCall(t *testing.T) {
+	cache := NewInMemCache()
+
+	started, release := make(chan bool), make(chan bool)
+	var callCount int32
+	slow := func() interface{} {
+		if atomic.AddInt32(&callCount, 1) == 1 {
+			started <- true
+			<-release
+		}
+		return "Slow!"
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, "Slow!", cache.Cache("slow", slow))
+	}()
+	<-started
+
+	// Anyone else either joins the call in flight, or hits the cache after it.
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "Slow!", cache.Cache("slow", slow))
+		}()
+	}
+
+	// Except when busting, which makes its own call rather than waiting.
+	withTestTimeout(t, 1000, func() {
+		cache.Bust(func() {
+			assert.Equal(t, "Slow!", cache.Cache("slow", slow))
+		})
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+}
+
+func TestSlowMissDoesntBlockOtherKeys(t *testing.T) {
+	for _, cache := range []*Cache{NewInMemCache(), New(newCopyOnWriteMap()), NewSyncMapCache()} {
+		started, release := make(chan bool), make(chan bool)
+		done := make(chan bool)
+		go func() {
+			cache.Cache("slow", func() interface{} {
+				started <- true
+				<-release
+				return "Slow!"
+			})
+			done <- true
+		}()
+		<-started
+
+		withTestTimeout(t, 1000, func() {
+			testCacheUse(t, cache, "fast", "Fast!", true)
+			testCacheUse(t, cache, "fast", "Fast!", false)
+		})
+		close(release)
+		<-done
+	}
+}
+
+func TestCacheKeyed(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	var gotKeys []interface{}
+	double := func(key interface{}) interface{} {
+		gotKeys = append(gotKeys, key)
+		return key.(int) * 2
+	}
+	assert.Equal(t, 4, cache.CacheKeyed(2, double))
+	assert.Equal(t, 6, cache.CacheKeyed(3, double))
+	assert.Equal(t, 4, cache.CacheKeyed(2, double))
+	assert.Equal(t, []interface{}{2, 3}, gotKeys)
+
+	testCacheUse(t, cache, 3, 6, false)
+}
+
+// A loader with its own state, like a database handle.
+type userTestLoader struct {
+	db    map[int]string
+	loads int
+	id    int
+}
+
+func (ul *userTestLoader) Load() interface{} {
+	ul.loads += 1
+	return ul.db[ul.id]
+}
+
+func TestCacheLoader(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	var callCount int
+	fn := LoaderFunc(func() interface{} {
+		callCount += 1
+		return "Foo!"
+	})
+	assert.Equal(t, "Foo!", cache.CacheLoader("foo", fn))
+	assert.Equal(t, "Foo!", cache.CacheLoader("foo", fn))
+	assert.Equal(t, 1, callCount)
+
+	loader := &userTestLoader{db: map[int]string{1: "Alice", 2: "Bob"}, id: 1}
+	assert.Equal(t, "Alice", cache.CacheLoader("user 1", loader))
+	loader.id = 2
+	assert.Equal(t, "Bob", cache.CacheLoader("user 2", loader))
+	assert.Equal(t, "Alice", cache.CacheLoader("user 1", loader))
+	assert.Equal(t, 2, loader.loads)
+
+	assert.Equal(t, "Bob", cache.CacheLoader("user 2", nil)) // Just a read
+	assert.PanicsWithValue(t, ErrNilLoader.Error(), func() { cache.CacheLoader("user 3", nil) })
+	testCacheUse(t, cache, "foo", "Foo!", false)
+}
+
+func TestCacheView(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	var fnCount, viewCount int
+	getView := func() interface{} {
+		return cache.CacheView("foo", func() interface{} {
+			fnCount += 1
+			return []string{"F", "o", "o"}
+		}, func(cached interface{}) interface{} {
+			viewCount += 1
+			return strings.Join(cached.([]string), "") + "!"
+		})
+	}
+
+	assert.Equal(t, "Foo!", getView())
+	assert.Equal(t, "Foo!", getView())
+	assert.Equal(t, "Foo!", getView())
+	assert.Equal(t, 1, fnCount)
+	assert.Equal(t, 3, viewCount)
+}
+
+func TestCacheProgress(t *testing.T) {
+	var reports []interface{}
+	cache := New(newSyncMap(), WithOnProgress(func(key, partial interface{}) {
+		assert.Equal(t, "count", key)
+		reports = append(reports, partial)
+	}))
+
+	count := func() interface{} {
+		return cache.CacheProgress("count", func(report func(partial interface{})) interface{} {
+			for i := 1; i < 3; i++ {
+				report(i)
+			}
+			return 3
+		})
+	}
+	assert.Equal(t, 3, count())
+	assert.Equal(t, []interface{}{1, 2}, reports)
+
+	assert.Equal(t, 3, count())
+	assert.Equal(t, []interface{}{1, 2}, reports) // No progress on a hit
+
+	// Without a hook, reports are dropped.
+	assert.Equal(t, 3, NewInMemCache().CacheProgress("count", func(report func(partial interface{})) interface{} {
+		report(1)
+		return 3
+	}))
+}
+
+// A store which can get and add many keys at once, counting how often it does.
+// It can't take a snapshot, so Export has to get its keys.
+type batchTestStore struct {
+	EnumerableStore
+	gets, adds int
+}
+
+func (bs *batchTestStore) GetMulti(keys []interface{}) map[interface{}]interface{} {
+	bs.gets++
+	found := make(map[interface{}]interface{})
+	for _, key := range keys {
+		if value, ok := bs.Get(key); ok {
+			found[key] = value
+		}
+	}
+	return found
+}
+
+func (bs *batchTestStore) AddMulti(values map[interface{}]interface{}) {
+	bs.adds++
+	for key, value := range values {
+		bs.Add(key, value)
+	}
+}
+
+func TestMultiCache(t *testing.T) {
+	var loaded [][]interface{}
+	loader := func(missing []interface{}) map[interface{}]interface{} {
+		loaded = append(loaded, missing)
+		values := make(map[interface{}]interface{})
+		for _, key := range missing {
+			if key != "none" {
+				values[key] = strings.ToUpper(key.(string))
+			}
+		}
+		return values
+	}
+
+	batch := &batchTestStore{EnumerableStore: newSyncMap()}
+	single := struct{ Store }{newSyncMap()} // Only one key at a time
+	for _, cache := range []*Cache{New(single), New(batch)} {
+		loaded = nil
+		cache.Set("b", "Bee")
+
+		values := cache.MultiCache([]interface{}{"a", "b", "c", "a", "none"}, loader)
+		assert.Equal(t, map[interface{}]interface{}{"a": "A", "b": "Bee", "c": "C"}, values)
+		assert.Equal(t, [][]interface{}{{"a", "c", "none"}}, loaded) // Only the misses
+
+		values = cache.MultiCache([]interface{}{"c", "d", "a"}, loader)
+		assert.Equal(t, map[interface{}]interface{}{"a": "A", "c": "C", "d": "D"}, values)
+		assert.Equal(t, []interface{}{"d"}, loaded[1])
+
+		values = cache.MultiCache([]interface{}{"a", "b"}, loader)
+		assert.Equal(t, map[interface{}]interface{}{"a": "A", "b": "Bee"}, values)
+		assert.Len(t, loaded, 2) // All hits, so no load
+
+		cache.Bust(func() {
+			cache.MultiCache([]interface{}{"a", "b"}, loader)
+		})
+		assert.Equal(t, []interface{}{"a", "b"}, loaded[2])
+		value, _ := cache.GetIfPresent("b")
+		assert.Equal(t, "B", value)
+	}
+	assert.Equal(t, 3, batch.gets) // Not when busting
+	assert.Equal(t, 3, batch.adds)
+}
+
+func TestCacheFirst(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	var callCount int
+	getSetting := func(keys ...interface{}) interface{} {
+		return cache.CacheFirst(keys, func() interface{} {
+			callCount += 1
+			return keys[0]
+		})
+	}
+
+	testCacheUse(t, cache, "tenant", "tenant", true)
+	assert.Equal(t, "tenant", getSetting("request", "tenant", "global"))
+	assert.Equal(t, 0, callCount)
+
+	assert.Equal(t, "other", getSetting("other", "global"))
+	assert.Equal(t, "other", getSetting("other", "global"))
+	assert.Equal(t, 1, callCount)
+	testCacheUse(t, cache, "other", "other", false)
+
+	cache.Bust(func() {
+		assert.Equal(t, "request", getSetting("request", "tenant", "global"))
+		assert.Equal(t, 2, callCount)
+	})
+	assert.Equal(t, "request", getSetting("request", "tenant", "global"))
+	assert.Equal(t, 2, callCount)
+
+	// Busting only some of the keys skips just those.
+	cache.BustOnly([]interface{}{"request"}, func() {
+		assert.Equal(t, "tenant", getSetting("request", "tenant", "global"))
+		assert.Equal(t, "request", getSetting("request", "global"))
+		assert.Equal(t, 3, callCount)
+	})
+
+	assert.PanicsWithValue(t, ErrNilLoader.Error(), func() {
+		cache.CacheFirst([]interface{}{"missing"}, nil)
+	})
+}
+
+func TestCacheFirstHooks(t *testing.T) {
+	var hits, misses []interface{}
+	cache := New(newSyncMap(),
+		WithTypeGuard(reflect.TypeOf("")),
+		WithOnHit(func(key, value interface{}) { hits = append(hits, key) }),
+		WithOnMiss(func(key interface{}) { misses = append(misses, key) }))
+
+	cache.store.Add("tenant", 42) // Fails the type guard
+	cache.store.Add("global", "Global!")
+	value := cache.CacheFirst([]interface{}{"request", "tenant", "global"}, func() interface{} { return "Request!" })
+	assert.Equal(t, "Global!", value)
+	assert.Equal(t, []interface{}{"global"}, hits)
+	assert.Empty(t, misses)
+
+	// Each call counts once, whichever keys were looked up.
+	value = cache.CacheFirst([]interface{}{"request", "tenant"}, func() interface{} { return "Request!" })
+	assert.Equal(t, "Request!", value)
+	assert.Equal(t, []interface{}{"request"}, misses)
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+}
+
+func TestCacheETag(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	_, ok := cache.ETag("foo")
+	assert.False(t, ok)
+
+	var callCount int
+	getFoo := func(etag string) (interface{}, string) {
+		return cache.CacheETag("foo", func() (interface{}, string) {
+			callCount += 1
+			return "Foo!", etag
+		})
+	}
+
+	value, etag := getFoo("v1")
+	assert.Equal(t, "Foo!", value)
+	assert.Equal(t, "v1", etag)
+	value, etag = getFoo("v2")
+	assert.Equal(t, "Foo!", value)
+	assert.Equal(t, "v1", etag)
+	assert.Equal(t, 1, callCount)
+
+	etag, ok = cache.ETag("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "v1", etag)
+
+	cache.Bust(func() {
+		value, etag = getFoo("v2")
+		assert.Equal(t, "Foo!", value)
+		assert.Equal(t, "v2", etag)
+		assert.Equal(t, 2, callCount)
+	})
+	etag, _ = cache.ETag("foo")
+	assert.Equal(t, "v2", etag)
+}
+
+func TestCache2(t *testing.T) {
+	cache := NewInMemCache()
+
+	var callCount int
+	lookup := func() (interface{}, interface{}) {
+		callCount += 1
+		return callCount, callCount%2 == 1
+	}
+	testLookup := func(value, found interface{}) {
+		v, f := cache.Cache2("foo", lookup)
+		assert.Equal(t, value, v)
+		assert.Equal(t, found, f)
+	}
+
+	testLookup(1, true)
+	testLookup(1, true)
+	cache.Bust(func() {
+		testLookup(2, false) // Both recomputed together
+	})
+	testLookup(2, false)
+	assert.Equal(t, 2, callCount)
+
+	v, f := cache.Wrap2(lookup)
+	assert.Equal(t, 3, v)
+	assert.Equal(t, true, f)
+	v, f = cache.Wrap2(lookup)
+	assert.Equal(t, 3, v)
+	assert.Equal(t, true, f)
+
+	// A single value found under the key is recomputed as a pair.
+	cache.Set("bar", "Bar!")
+	v, f = cache.Cache2("bar", func() (interface{}, interface{}) { return "Bar!", 42 })
+	assert.Equal(t, "Bar!", v)
+	assert.Equal(t, 42, f)
+}
+
+func TestCacheMeta(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	_, ok := cache.Meta("foo")
+	assert.False(t, ok)
+
+	var callCount int
+	getFoo := func(meta map[string]interface{}) interface{} {
+		return cache.CacheMeta("foo", meta, func() interface{} {
+			callCount += 1
+			return "Foo!"
+		})
+	}
+
+	meta := map[string]interface{}{"source": "db", "trace": 42}
+	assert.Equal(t, "Foo!", getFoo(meta))
+	assert.Equal(t, "Foo!", getFoo(map[string]interface{}{"source": "other"}))
+	assert.Equal(t, 1, callCount)
+
+	got, ok := cache.Meta("foo")
+	assert.True(t, ok)
+	assert.Equal(t, meta, got)
+}
+
+func TestCacheVersioned(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	version := "v1"
+	var versionErr, fnErr error
+	currentVersion := func() (string, error) { return version, versionErr }
+
+	var callCount int
+	getFoo := func() (interface{}, error) {
+		return cache.CacheVersioned("foo", currentVersion, func() (interface{}, error) {
+			callCount += 1
+			return fmt.Sprintf("Foo %s!", version), fnErr
+		})
+	}
+
+	value, err := getFoo()
+	assert.NoError(t, err)
+	assert.Equal(t, "Foo v1!", value)
+	value, _ = getFoo()
+	assert.Equal(t, "Foo v1!", value)
+	assert.Equal(t, 1, callCount) // Unchanged version, so served from the cache
+
+	version = "v2"
+	value, _ = getFoo()
+	assert.Equal(t, "Foo v2!", value)
+	assert.Equal(t, 2, callCount) // Changed version, so recomputed
+
+	versionErr = errors.New("version unavailable")
+	_, err = getFoo()
+	assert.Equal(t, versionErr, err)
+	assert.Equal(t, 2, callCount)
+
+	versionErr, fnErr = nil, errors.New("fetch failed")
+	version = "v3"
+	_, err = getFoo()
+	assert.Equal(t, fnErr, err)
+	fnErr = nil
+	value, _ = getFoo()
+	assert.Equal(t, "Foo v3!", value) // The error wasn't cached
+	assert.Equal(t, 4, callCount)
+}
+
+func TestIncrement(t *testing.T) {
+	cache := NewInMemCache()
+
+	var seeded int
+	initial := func() int64 {
+		seeded += 1
+		return 100
+	}
+	assert.Equal(t, int64(100), cache.Increment("counter", 1, initial))
+	assert.Equal(t, int64(101), cache.Increment("counter", 1, initial))
+	assert.Equal(t, int64(96), cache.Increment("counter", -5, initial))
+	assert.Equal(t, 1, seeded)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.Increment("concurrent", 1, func() int64 { return 1 })
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(5001), cache.Increment("concurrent", 1, initial))
+}
+
+func TestIncrementHooks(t *testing.T) {
+	var cache *Cache
+	var replaced []interface{}
+	cache = NewInMemCache(WithOnReplace(func(key, oldValue, newValue interface{}) {
+		replaced = append(replaced, newValue)
+		if newValue == int64(2) {
+			cache.Increment(key, 10, nil) // The hooks can use the same key
+		}
+	}))
+
+	withTestTimeout(t, 500, func() {
+		cache.Increment("counter", 1, func() int64 { return 1 })
+		assert.Equal(t, int64(2), cache.Increment("counter", 1, nil))
+	})
+	assert.Equal(t, []interface{}{int64(2), int64(12)}, replaced)
+	assert.Equal(t, int64(12), cache.Cache("counter", nil))
+}
+
+func TestOnce(t *testing.T) {
+	cache := NewInMemCache()
+
+	var callCount int
+	register := func() { callCount += 1 }
+
+	cache.Once("metric", register)
+	cache.Once("metric", register)
+	cache.Bust(func() {
+		cache.Once("metric", register)
+	})
+	assert.Equal(t, 1, callCount)
+
+	cache.Once("other", register)
+	assert.Equal(t, 2, callCount)
+
+	// Values under the same key are separate.
+	testCacheUse(t, cache, "metric", "Foo!", true)
+	cache.Once("metric", register)
+	assert.Equal(t, 2, callCount)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Once("concurrent", func() {
+				time.Sleep(time.Millisecond)
+				register()
+			})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, callCount)
+}
+
+func TestCacheTTLFunc(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock))
+
+	var callCount int
+	ttlOf := func(value interface{}) time.Duration {
+		return time.Duration(value.(int)) * time.Second
+	}
+	getValue := func(key interface{}, value int) interface{} {
+		return cache.CacheTTLFunc(key, func() interface{} {
+			callCount += 1
+			return value
+		}, ttlOf)
+	}
+
+	assert.Equal(t, 1, getValue("short", 1))
+	assert.Equal(t, 10, getValue("long", 10))
+	assert.Equal(t, 2, callCount)
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, 1, getValue("short", 1))
+	assert.Equal(t, 10, getValue("long", 10))
+	assert.Equal(t, 2, callCount)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, getValue("short", 1)) // Expired
+	assert.Equal(t, 10, getValue("long", 10))
+	assert.Equal(t, 3, callCount)
+
+	// A zero TTL means the value isn't cached at all.
+	assert.Equal(t, 0, getValue("zero", 0))
+	assert.Equal(t, 0, getValue("zero", 0))
+	assert.Equal(t, 5, callCount)
+}
+
+func TestCacheWithTTL(t *testing.T) {
+	clock := newTestClock()
+	store := &noisyTestStore{t: t, m: make(map[interface{}]interface{})}
+	cache := New(store, WithClock(clock))
+
+	var callCount int
+	getValue := func(key interface{}, ttl time.Duration) interface{} {
+		return cache.CacheWithTTL(key, ttl, func() interface{} {
+			callCount += 1
+			return callCount
+		})
+	}
+
+	assert.Equal(t, 1, getValue("foo", time.Minute))
+	assert.Equal(t, 2, getValue("forever", 0))
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, 1, getValue("foo", time.Minute))
+	assert.Equal(t, 2, getValue("forever", 0))
+
+	clock.Advance(time.Second)
+	assert.Equal(t, 3, getValue("foo", time.Minute)) // Expired, so recomputed
+	assert.Equal(t, 3, getValue("foo", time.Minute))
+	assert.Equal(t, 3, cache.Cache("foo", nil)) // Readable by Cache too, until it expires
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, 2, getValue("forever", -time.Second))
+	assert.Equal(t, 3, callCount)
+}
+
+func TestTTLJitter(t *testing.T) {
+	clock := newTestClock()
+	expiries := func(seed int64) []time.Duration {
+		store := newSyncMap()
+		cache := New(store, WithClock(clock), WithTTLJitter(0.2), WithRandSource(rand.NewSource(seed)))
+		var spread []time.Duration
+		for key := 0; key < 20; key++ {
+			cache.CacheWithTTL(key, time.Minute, func() interface{} { return key })
+			cache.CacheWithTTL(key, time.Minute, nil) // Reading doesn't change it
+			data, _ := store.Get(key)
+			spread = append(spread, data.(ttlEntry).expiresAt.Sub(clock.Now()))
+		}
+		return spread
+	}
+
+	spread := expiries(1)
+	distinct := make(map[time.Duration]bool)
+	for _, ttl := range spread {
+		assert.True(t, ttl >= 48*time.Second && ttl <= 72*time.Second, "TTL out of range: %v", ttl)
+		distinct[ttl] = true
+	}
+	assert.True(t, len(distinct) > 15, "TTLs not spread out: %v", spread)
+	assert.Equal(t, spread, expiries(1)) // Same seed, same jitter
+}
+
+func TestForeignValuesAreRecomputed(t *testing.T) {
+	clock := newTestClock()
+	store := newSyncMap()
+	cache := New(store, WithClock(clock))
+
+	// A raw value, without an expiry, as if written by someone else.
+	store.Add("foo", "Raw!")
+	assert.Equal(t, "Foo!", cache.CacheWithTTL("foo", time.Minute, func() interface{} { return "Foo!" }))
+	assert.Equal(t, "Foo!", cache.CacheWithTTL("foo", time.Minute, func() interface{} { return "Again!" }))
+	clock.Advance(time.Minute)
+	assert.Equal(t, "Again!", cache.CacheWithTTL("foo", time.Minute, func() interface{} { return "Again!" }))
+
+	// And likewise for other methods which wrap up their values.
+	store.Add("bar", 42)
+	first, second := cache.Cache2("bar", func() (interface{}, interface{}) { return "Bar!", true })
+	assert.Equal(t, "Bar!", first)
+	assert.Equal(t, true, second)
+	value, etag := cache.CacheETag("bar", func() (interface{}, string) { return "Bar!", "v1" })
+	assert.Equal(t, "Bar!", value)
+	assert.Equal(t, "v1", etag)
+}
+
+func TestCacheStale(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock))
+
+	var version int32
+	refreshing := make(chan chan bool, 1)
+	getFoo := func() interface{} {
+		return cache.CacheStale("foo", time.Minute, time.Minute, func() interface{} {
+			v := atomic.AddInt32(&version, 1)
+			if v > 1 {
+				release := make(chan bool)
+				refreshing <- release
+				<-release
+			}
+			return v
+		})
+	}
+
+	assert.Equal(t, int32(1), getFoo())
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, int32(1), getFoo()) // Fresh
+
+	// Stale, so returned right away while it's refreshed.
+	clock.Advance(30 * time.Second)
+	withTestTimeout(t, 1000, func() {
+		assert.Equal(t, int32(1), getFoo())
+	})
+	release := <-refreshing
+	assert.Equal(t, int32(1), getFoo()) // Still refreshing; no second refresh
+	assert.True(t, cache.InFlight("foo"))
+	close(release)
+	for cache.InFlight("foo") {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(2), getFoo())
+
+	// Long expired, so we wait for a fresh value.
+	clock.Advance(2 * time.Minute)
+	go func() { close(<-refreshing) }()
+	assert.Equal(t, int32(3), getFoo())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&version))
+}
+
+func TestCacheTimed(t *testing.T) {
+	clock := newTickingTestClock()
+	cache := New(newSyncMap(), WithClock(clock))
+
+	var version int32
+	nextVersion := func() interface{} { return atomic.AddInt32(&version, 1) }
+
+	stop := cache.CacheTimed("foo", time.Minute, nextVersion)
+	value, _ := cache.GetIfPresent("foo")
+	assert.Equal(t, int32(1), value)
+
+	// A second call for the same key doesn't start another refresh.
+	stop2 := cache.CacheTimed("foo", time.Minute, nextVersion)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&version))
+
+	clock.Tick(time.Minute)
+	clock.Tick(time.Minute) // Only sent once the first refresh is done
+	stop()
+	value, _ = cache.GetIfPresent("foo")
+	assert.Equal(t, int32(3), value)
+
+	// Stopped, so no more refreshes.
+	select {
+	case clock.ticks <- clock.Now():
+		t.Error("still refreshing after stop")
+	case <-time.After(10 * time.Millisecond):
+	}
+	stop2() // Safe to call again
+
+	// Once stopped, it can be started again.
+	stop = cache.CacheTimed("foo", time.Minute, nextVersion)
+	defer stop()
+	value, _ = cache.GetIfPresent("foo")
+	assert.Equal(t, int32(4), value)
+}
+
+func TestCacheTimedNested(t *testing.T) {
+	clock := newTickingTestClock()
+	cache := New(newSyncMap(), WithClock(clock))
+
+	// The function can start refreshing other keys, or find its own.
+	var stopBar, stopFoo func()
+	done := make(chan bool)
+	go func() {
+		stop := cache.CacheTimed("foo", time.Minute, func() interface{} {
+			stopBar = cache.CacheTimed("bar", time.Minute, func() interface{} { return "Bar!" })
+			stopFoo = cache.CacheTimed("foo", time.Minute, func() interface{} { return "Nope" })
+			return "Foo!"
+		})
+		stop()
+		stopBar()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deadlocked")
+	}
+	stopFoo() // Same as stop
+
+	value, _ := cache.GetIfPresent("foo")
+	assert.Equal(t, "Foo!", value)
+	value, _ = cache.GetIfPresent("bar")
+	assert.Equal(t, "Bar!", value)
+
+	// If the function panics, nothing is left refreshing the key.
+	assert.Panics(t, func() {
+		cache.CacheTimed("baz", time.Minute, func() interface{} { panic("oops") })
+	})
+	stop := cache.CacheTimed("baz", time.Minute, func() interface{} { return "Baz!" })
+	defer stop()
+	value, _ = cache.GetIfPresent("baz")
+	assert.Equal(t, "Baz!", value)
+}
+
+func TestDefaultTTL(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock), WithDefaultTTL(time.Minute))
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	cache.CacheWithTTL("long", time.Hour, func() interface{} { return "Long!" })
+	clock.Advance(59 * time.Second)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+
+	clock.Advance(time.Second)
+	testCacheUse(t, cache, "foo", "Foo!", true) // Expired
+	testCacheUse(t, cache, "long", "Long!", false)
+}
+
+func TestOnReplace(t *testing.T) {
+	type replacement struct{ key, old, new interface{} }
+	var replaced []replacement
+	cache := NewInMemCache(WithOnReplace(func(key, oldValue, newValue interface{}) {
+		replaced = append(replaced, replacement{key, oldValue, newValue})
+	}))
+
+	version := 1
+	getFoo := func() interface{} {
+		return cache.Cache("foo", func() interface{} { return version })
+	}
+
+	assert.Equal(t, 1, getFoo())
+	assert.Equal(t, 1, getFoo())
+	assert.Empty(t, replaced) // Nothing to replace on the first store
+
+	version = 2
+	cache.Bust(func() {
+		assert.Equal(t, 2, getFoo())
+	})
+	assert.Equal(t, []replacement{{"foo", 1, 2}}, replaced)
+}
+
+func TestObserverHooks(t *testing.T) {
+	var events []string
+	cache := NewInMemCache(
+		WithOnAdd(func(key, value interface{}) { events = append(events, fmt.Sprintf("add %v %v", key, value)) }),
+		WithOnHit(func(key, value interface{}) { events = append(events, fmt.Sprintf("hit %v %v", key, value)) }),
+		WithOnMiss(func(key interface{}) { events = append(events, fmt.Sprintf("miss %v", key)) }),
+	)
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	cache.Bust(func() {
+		testCacheUse(t, cache, "foo", "Foo!", true)
+	})
+	cache.Set("bar", "Bar!")
+	cache.GetIfPresent("bar") // Just a read, not a lookup
+
+	assert.Equal(t, []string{
+		"miss foo", "add foo Foo!",
+		"hit foo Foo!",
+		"miss foo", "add foo Foo!",
+		"add bar Bar!",
+	}, events)
+}
+
+func TestNegativeTTL(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock),
+		WithNegativeTTL(10*time.Second, 5*time.Second),
+		WithRandSource(rand.NewSource(1)))
+
+	var callCount int
+	lookup := func(key int) interface{} {
+		return cache.Cache(key, func() interface{} {
+			callCount += 1
+			if key%2 == 0 {
+				return key
+			}
+			return ErrNotFound
+		})
+	}
+
+	// Returns how many lookups had to be recomputed.
+	const numKeys = 40
+	lookupAll := func() int {
+		before := callCount
+		for key := 0; key < numKeys; key++ {
+			lookup(key)
+		}
+		return callCount - before
+	}
+
+	assert.Equal(t, numKeys, lookupAll())
+	assert.Equal(t, ErrNotFound, lookup(1))
+
+	clock.Advance(10*time.Second - time.Nanosecond)
+	assert.Equal(t, 0, lookupAll()) // Nothing expires before the base TTL
+
+	clock.Advance(2500 * time.Millisecond)
+	expired := lookupAll()
+	assert.True(t, expired > 0 && expired < numKeys/2, "some, but not all, should expire: %d", expired)
+
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, numKeys/2-expired, lookupAll()) // The rest expire within the jitter
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, numKeys/2, lookupAll()) // Only negative entries ever expire
+}
+
+func TestNegativeTTLWithCacheErrAndTTL(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock), WithNegativeTTL(5*time.Second, 0))
+
+	var calls int
+	found := map[string]bool{"alice": true}
+	fetch := func(name string) (interface{}, error) {
+		return cache.CacheErr(name, func() (interface{}, error) {
+			calls++
+			if !found[name] {
+				return nil, fmt.Errorf("user %s: %w", name, ErrNotFound)
+			}
+			return "User " + name, nil
+		})
+	}
+	fetchTTL := func(name string) interface{} {
+		return cache.CacheWithTTL("ttl/"+name, 5*time.Minute, func() interface{} {
+			calls++
+			if !found[name] {
+				return ErrNotFound
+			}
+			return "User " + name
+		})
+	}
+
+	value, err := fetch("alice")
+	assert.Equal(t, "User alice", value)
+	assert.NoError(t, err)
+	_, err = fetch("bob")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, "User alice", fetchTTL("alice"))
+	assert.Equal(t, ErrNotFound, fetchTTL("bob"))
+	assert.Equal(t, 4, calls)
+
+	// Not found is cached, and counted separately.
+	_, err = fetch("bob")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, ErrNotFound, fetchTTL("bob"))
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, uint64(2), cache.Stats().NegativeHits)
+
+	// After the negative TTL, not found is looked up again, but found isn't.
+	found["bob"] = true
+	clock.Advance(5 * time.Second)
+	value, err = fetch("bob")
+	assert.Equal(t, "User bob", value)
+	assert.NoError(t, err)
+	assert.Equal(t, "User bob", fetchTTL("bob"))
+	fetch("alice")
+	fetchTTL("alice")
+	assert.Equal(t, 6, calls)
+
+	// Until the positive TTL has passed.
+	clock.Advance(5 * time.Minute)
+	fetchTTL("alice")
+	assert.Equal(t, 7, calls)
+
+	// Without a negative TTL, errors aren't cached by CacheErr.
+	cache = New(newSyncMap())
+	cache.CacheErr("bob", func() (interface{}, error) { return nil, ErrNotFound })
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestMinRecomputeInterval(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock), WithMinRecomputeInterval(time.Minute))
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	cache.Bust(func() {
+		testCacheUse(t, cache, "foo", "Foo!", false)
+	})
+
+	clock.Advance(30 * time.Second)
+	cache.Bust(func() {
+		testCacheUse(t, cache, "foo", "Foo!", false)
+	})
+
+	clock.Advance(30 * time.Second)
+	cache.Bust(func() {
+		testCacheUse(t, cache, "foo", "Foo!", true)
+		testCacheUse(t, cache, "foo", "Foo!", false)
+	})
+}
+
+func TestPriorityCache(t *testing.T) {
+	cache, err := NewPriorityCache(2, func(key, value interface{}) int {
+		return value.(int)
+	})
+	assert.NoError(t, err)
+
+	testCacheUse(t, cache, "high", 5, true)
+	testCacheUse(t, cache, "low", 1, true)
+	testCacheUse(t, cache, "low", 1, false) // Recently used, but still lowest
+	testCacheUse(t, cache, "mid", 3, true)  // Evicts "low"
+
+	testCacheUse(t, cache, "high", 5, false)
+	testCacheUse(t, cache, "mid", 3, false)
+	testCacheUse(t, cache, "low", 1, true) // Evicts itself
+	testCacheUse(t, cache, "high", 5, false)
+	testCacheUse(t, cache, "mid", 3, false)
+
+	// Ties are broken by evicting the oldest.
+	testCacheUse(t, cache, "also-mid", 3, true) // Evicts "mid"
+	testCacheUse(t, cache, "also-mid", 3, false)
+	testCacheUse(t, cache, "mid", 3, true)
+	assert.Equal(t, 2, cache.Len())
+	assert.ElementsMatch(t, []interface{}{"high", "mid"}, cache.Keys())
+
+	// Priorities are worked out from the values as cached, and keys are stored
+	// like in any other store.
+	cache, _ = NewPriorityCache(2, func(key, value interface{}) int {
+		return len(value.(string))
+	}, WithDefaultTTL(time.Hour))
+	testCacheUse(t, cache, []int{1}, "Long!", true)
+	testCacheUse(t, cache, []int{1}, "Long!", false)
+	cache.CacheETag("short", func() (interface{}, string) { return "S", "v1" })
+	testCacheUse(t, cache, "longest", "Longest!", true) // Evicts "short"
+	_, ok := cache.ETag("short")
+	assert.False(t, ok)
+
+	_, err = NewPriorityCache(0, func(key, value interface{}) int { return 0 })
+	assert.Error(t, err)
+	_, err = NewPriorityCache(2, nil)
+	assert.Error(t, err)
+}
+
+func TestLRUCache(t *testing.T) {
+	cache, err := NewLRUCache(2)
+	assert.NoError(t, err)
+
+	testCacheUse(t, cache, "a", "A!", true)
+	testCacheUse(t, cache, "b", "B!", true)
+	testCacheUse(t, cache, "a", "A!", false) // Now "b" is the oldest
+	testCacheUse(t, cache, "c", "C!", true)  // Evicts "b"
+
+	testCacheUse(t, cache, "a", "A!", false)
+	testCacheUse(t, cache, "c", "C!", false)
+	testCacheUse(t, cache, "b", "B!", true) // Evicts "a"
+	assert.Equal(t, []interface{}{"b", "c"}, cache.store.(EnumerableStore).Keys())
+
+	// Busting recomputes and re-adds a value, even once it's been evicted.
+	cache.Bust(func() {
+		testCacheUse(t, cache, "a", "A!", true) // Evicts "c"
+	})
+	testCacheUse(t, cache, "a", "A!", false)
+	testCacheUse(t, cache, "b", "B!", false)
+	testCacheUse(t, cache, "c", "C!", true)
+
+	_, err = NewLRUCache(0)
+	assert.Error(t, err)
+}
+
+func TestWithOnEvict(t *testing.T) {
+	var evicted []string
+	onEvict := WithOnEvict(func(key, value interface{}) {
+		evicted = append(evicted, fmt.Sprintf("%v=%v", key, value))
+	})
+	cache, err := NewLRUCache(2, onEvict, WithEntryTracking())
+	assert.NoError(t, err)
+
+	testCacheUse(t, cache, "a", "A!", true)
+	testCacheUse(t, cache, "b", "B!", true)
+	cache.Set("a", "AA!") // Replacing isn't evicting
+	assert.Empty(t, evicted)
+	testCacheUse(t, cache, "c", "C!", true) // Evicts "b"
+	assert.Equal(t, []string{"b=B!"}, evicted)
+	cache.Delete("a") // Nor is removing
+	assert.Equal(t, []string{"b=B!"}, evicted)
+	_, tracked := cache.entries.m["b"]
+	assert.False(t, tracked) // The cache forgets about it, too
+
+	sized, err := NewSizedCache(4, func(value interface{}) int64 { return int64(len(value.(string))) }, onEvict)
+	assert.NoError(t, err)
+	sized.Set("x", "xx")
+	sized.Set("y", "yyy") // Evicts "x"
+	assert.Equal(t, []string{"b=B!", "x=xx"}, evicted)
+}
+
+func TestSizedCache(t *testing.T) {
+	cache, err := NewSizedCache(10, func(value interface{}) int64 {
+		return int64(len(value.(string)))
+	})
+	assert.NoError(t, err)
+	store := cache.store.(*lruStore)
+
+	testCacheUse(t, cache, "a", "aaaa", true)
+	testCacheUse(t, cache, "b", "bbbb", true)
+	testCacheUse(t, cache, "a", "aaaa", false) // Now "b" is the oldest
+	assert.Equal(t, int64(8), store.bytes)
+	testCacheUse(t, cache, "c", "ccccccc", true) // Evicts "b", then "a"
+	assert.Equal(t, []interface{}{"c"}, store.Keys())
+	assert.Equal(t, int64(7), store.bytes)
+
+	testCacheUse(t, cache, "d", "dd", true)
+	testCacheUse(t, cache, "e", "ee", true) // Evicts "c"
+	assert.Equal(t, []interface{}{"e", "d"}, store.Keys())
+	assert.Equal(t, int64(4), store.bytes)
+
+	// A value too big to ever fit isn't stored, and nothing's evicted for it.
+	testCacheUse(t, cache, "big", "bigbigbigbig", true)
+	testCacheUse(t, cache, "big", "bigbigbigbig", true)
+	assert.Equal(t, []interface{}{"e", "d"}, store.Keys())
+
+	// Replacing a value accounts for the change in size.
+	cache.Set("d", "dddddddd") // Exactly fits
+	assert.Equal(t, []interface{}{"d", "e"}, store.Keys())
+	cache.Set("d", "ddddddddd") // Evicts "e"
+	assert.Equal(t, []interface{}{"d"}, store.Keys())
+	assert.Equal(t, int64(9), store.bytes)
+	cache.Delete("d")
+	assert.Equal(t, int64(0), store.bytes)
+
+	// Values are sized as they were cached, not as the cache wraps them up.
+	cache.CacheETag("etag", func() (interface{}, string) { return "etag", "v1" })
+	assert.Equal(t, int64(4), store.bytes)
+	cache.Delete("etag")
+
+	_, err = NewSizedCache(0, func(interface{}) int64 { return 1 })
+	assert.Error(t, err)
+	_, err = NewSizedCache(10, nil)
+	assert.Error(t, err)
+}
+
+func TestLoggingStore(t *testing.T) {
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	cache := New(NewLoggingStore(newSyncMap(), logf))
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	cache.Delete("foo")
+	cache.Clear()
+	assert.Equal(t, []string{
+		"funcache: Get(foo) -> (<nil>, false)",
+		"funcache: Add(foo, Foo!)",
+		"funcache: Get(foo) -> (Foo!, true)",
+		"funcache: Remove(foo)",
+		"funcache: Purge()",
+	}, logged)
+
+	// It can only do what the inner store can.
+	assert.Equal(t, capsOf(newSyncMap()), capsOf(NewLoggingStore(newSyncMap(), logf)))
+	assert.Equal(t, storeCaps(0), capsOf(NewLoggingStore(struct{ Store }{newSyncMap()}, logf)))
+}
+
+func TestLoadingStore(t *testing.T) {
+	var logged, loaded []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	store := NewLoadingStore(NewLoggingStore(newSyncMap(), logf), func(key interface{}) (interface{}, bool) {
+		loaded = append(loaded, key.(string))
+		if key == "none" {
+			return nil, false
+		}
+		return strings.ToUpper(key.(string)) + "!", true
+	})
+
+	value, ok := store.Get("foo") // Cold, so loaded
+	assert.True(t, ok)
+	assert.Equal(t, "FOO!", value)
+	value, ok = store.Get("foo") // Straight from the inner store
+	assert.True(t, ok)
+	assert.Equal(t, "FOO!", value)
+	_, ok = store.Get("none")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"foo", "none"}, loaded)
+	assert.Equal(t, []string{
+		"funcache: Get(foo) -> (<nil>, false)",
+		"funcache: Add(foo, FOO!)",
+		"funcache: Get(foo) -> (FOO!, true)",
+		"funcache: Get(none) -> (<nil>, false)",
+	}, logged)
+
+	// Under a cache, the store loads values before the cache's own function is
+	// needed.
+	cache := New(store)
+	assert.Equal(t, "BAR!", cache.Cache("bar", func() interface{} { return "Bar?" }))
+	assert.Equal(t, "None!", cache.Cache("none", func() interface{} { return "None!" }))
+	assert.Equal(t, []string{"foo", "none", "bar", "none"}, loaded)
+	assert.Equal(t, 3, cache.Len())
+
+	// It can only do what the inner store can.
+	loader := func(key interface{}) (interface{}, bool) { return nil, false }
+	assert.Equal(t, storeCaps(0), capsOf(NewLoadingStore(struct{ Store }{newSyncMap()}, loader)))
+}
+
+func TestWithCaps(t *testing.T) {
+	for caps := storeCaps(0); caps <= allCaps; caps++ {
+		store := withCaps(newSyncMap(), caps)
+		assert.Equal(t, caps, capsOf(store))
+		store.Add("foo", "Foo!")
+		value, ok := store.Get("foo")
+		assert.True(t, ok)
+		assert.Equal(t, "Foo!", value)
+	}
+	assert.Equal(t, canRemove|canCount, capsOf(newSyncMap(), withCaps(newSyncMap(), canRemove|canCount)))
+}
+
+func TestTieredStore(t *testing.T) {
+	l1, l2 := newSyncMap(), newSyncMap()
+	cache := New(NewTiered(l1, l2))
+
+	// Writes go to both tiers.
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	_, ok := l1.Get("foo")
+	assert.True(t, ok)
+	_, ok = l2.Get("foo")
+	assert.True(t, ok)
+
+	// An L1 miss with an L2 hit is promoted to L1.
+	l2.Add("bar", "Bar!")
+	testCacheUse(t, cache, "bar", "Bar!", false)
+	value, ok := l1.Get("bar")
+	assert.True(t, ok)
+	assert.Equal(t, "Bar!", value)
+
+	cache.Delete("foo")
+	_, ok = l2.Get("foo")
+	assert.False(t, ok)
+	cache.Clear()
+	assert.Equal(t, 0, l1.Len()+l2.Len())
+
+	// Keys can only be removed if both tiers can remove them.
+	store := NewTiered(newSyncMap(), struct{ Store }{newSyncMap()})
+	_, ok = store.(RemovableStore)
+	assert.False(t, ok)
+	_, ok = store.(PurgeableStore)
+	assert.False(t, ok)
+}
+
+func TestWriteBackCache(t *testing.T) {
+	mem, backing := newSyncMap(), newSyncMap()
+	backing.Add("old", "Old!")
+	cache, stop := NewWriteBackCache(mem, backing, time.Hour)
+
+	testCacheUse(t, cache, "old", "Old!", false) // Read from backing
+	_, ok := mem.Get("old")
+	assert.True(t, ok)
+
+	testCacheUse(t, cache, "new", "New!", true)
+	testCacheUse(t, cache, "new", "New!", false)
+	_, ok = backing.Get("new")
+	assert.False(t, ok) // Not flushed yet
+
+	stop()
+	stop() // Safe to call again
+	value, ok := backing.Get("new")
+	assert.True(t, ok)
+	assert.Equal(t, "New!", value)
+}
+
+func TestWriteBackCacheFlushes(t *testing.T) {
+	backing := newSyncMap()
+	cache, stop := NewWriteBackCache(newSyncMap(), backing, time.Millisecond)
+	defer stop()
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	withTestTimeout(t, 500, func() {
+		for {
+			if _, ok := backing.Get("foo"); ok {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestWriteBackReadsUnflushed(t *testing.T) {
+	mem, backing := newSyncMap(), newSyncMap()
+	backing.Add("foo", "Old!")
+	ws := newWriteBackStore(mem, backing)
+
+	// Evicted from mem before it's flushed, it's still found.
+	ws.Add("foo", "Foo!")
+	mem.Remove("foo")
+	value, ok := ws.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "Foo!", value)
+
+	ws.flush()
+	mem.Remove("foo")
+	value, ok = ws.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "Foo!", value)
+}
+
+func TestWriteBackCacheBadInterval(t *testing.T) {
+	assert.PanicsWithValue(t, "funcache: flushInterval must be positive", func() {
+		NewWriteBackCache(newSyncMap(), newSyncMap(), 0)
+	})
+}
+
+// Store whose Add waits to be released, to catch a flush half way.
+type blockingAddStore struct {
+	*syncMap
+	adding, release chan bool
+}
+
+func (bs *blockingAddStore) Add(key, value interface{}) {
+	bs.adding <- true
+	<-bs.release
+	bs.syncMap.Add(key, value)
+}
+
+func TestWriteBackRemoveWhileFlushing(t *testing.T) {
+	backing := &blockingAddStore{newSyncMap(), make(chan bool), make(chan bool)}
+	ws := newWriteBackStore(newSyncMap(), backing)
+	ws.Add("foo", "Foo!")
+
+	flushed := make(chan bool)
+	go func() {
+		ws.flush()
+		flushed <- true
+	}()
+	<-backing.adding
+
+	// Removing the key while it's being flushed waits for the flush, rather
+	// than letting it write the value back afterwards.
+	removed := make(chan bool)
+	go func() {
+		ws.Remove("foo")
+		removed <- true
+	}()
+	select {
+	case <-removed:
+		t.Fatal("removed while flushing")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(backing.release)
+	<-flushed
+	<-removed
+	_, ok := backing.Get("foo")
+	assert.False(t, ok)
+	_, ok = ws.Get("foo")
+	assert.False(t, ok)
+}
+
+func TestPurgeOlderThan(t *testing.T) {
+	clock := newTestClock()
+	start := clock.Now()
+	cache := New(newSyncMap(), WithClock(clock), WithEntryTracking())
+
+	testCacheUse(t, cache, "a", "A!", true)
+	clock.Advance(time.Minute)
+	testCacheUse(t, cache, "b", "B!", true)
+	clock.Advance(time.Minute)
+	testCacheUse(t, cache, "c", "C!", true)
+
+	assert.Equal(t, 2, cache.PurgeOlderThan(start.Add(90*time.Second)))
+	assert.Equal(t, 0, cache.PurgeOlderThan(start.Add(90*time.Second)))
+
+	testCacheUse(t, cache, "c", "C!", false)
+	testCacheUse(t, cache, "a", "A!", true)
+	testCacheUse(t, cache, "b", "B!", true)
+
+	// Without tracking, nothing can be purged.
+	cache = NewInMemCache()
+	testCacheUse(t, cache, "a", "A!", true)
+	assert.Equal(t, 0, cache.PurgeOlderThan(clock.Now().Add(time.Hour)))
+	testCacheUse(t, cache, "a", "A!", false)
+}
+
+func TestAlias(t *testing.T) {
+	store := newSyncMap()
+	cache := New(store)
+
+	testCacheUse(t, cache, 42, "Bob!", true)
+	cache.Alias("bob", 42)
+	testCacheUse(t, cache, "bob", "Bob!", false)
+
+	cache.Alias("bobby", "bob")
+	testCacheUse(t, cache, "bobby", "Bob!", false)
+	assert.Len(t, store.m, 1) // Only stored once
+
+	cache.Alias("alice", 7) // Not cached yet
+	testCacheUse(t, cache, "alice", "Alice!", true)
+	testCacheUse(t, cache, 7, "Alice!", false)
+
+	assert.PanicsWithValue(t, "funcache: alias cycle on key 42", func() {
+		cache.Alias(42, "bobby")
+	})
+	assert.Panics(t, func() { cache.Alias("x", "x") })
+	testCacheUse(t, cache, "bobby", "Bob!", false)
+
+	// Even cycles longer than the aliases followed when resolving.
+	for i := 1; i <= maxAliasDepth+2; i++ {
+		cache.Alias(i*100, (i-1)*100)
+	}
+	assert.PanicsWithValue(t, "funcache: alias cycle on key 0", func() {
+		cache.Alias(0, (maxAliasDepth+2)*100)
+	})
+}
+
+func TestTypeGuard(t *testing.T) {
+	store := newSyncMap()
+	store.Add("foo", 123)
+	store.Add("bar", "Bar!")
+
+	var mismatches []interface{}
+	cache := New(store, WithTypeGuard(reflect.TypeOf("")), WithOnTypeMismatch(func(key, value interface{}) {
+		mismatches = append(mismatches, key, value)
+	}))
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	testCacheUse(t, cache, "bar", "Bar!", false)
+	assert.Equal(t, []interface{}{"foo", 123}, mismatches)
+
+	// Interfaces can be guarded for, too.
+	store.Add("err", "not an error")
+	store.Add("nil", nil)
+	cache = New(store, WithTypeGuard(reflect.TypeOf((*error)(nil)).Elem()))
+	testCacheUse(t, cache, "err", assert.AnError, true)
+	testCacheUse(t, cache, "err", assert.AnError, false)
+	testCacheUse(t, cache, "nil", nil, false)
+}
+
+func TestLoadTiming(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock), WithLoadTiming())
+	load := func(key string, took time.Duration) {
+		cache.Cache(key, func() interface{} {
+			clock.Advance(took) // As if it took that long
+			return key
+		})
+	}
+
+	load("fast", time.Millisecond)
+	load("slow", time.Second)
+	load("medium", 100*time.Millisecond)
+	load("slow", time.Minute) // A hit, so not timed
+	assert.Equal(t, map[interface{}]time.Duration{
+		"fast":   time.Millisecond,
+		"slow":   time.Second,
+		"medium": 100 * time.Millisecond,
+	}, cache.LoadStats())
+
+	cache.Bust(func() { load("fast", 2*time.Second) }) // Only the last load is kept
+	assert.Equal(t, []KeyDuration{{"fast", 2 * time.Second}, {"slow", time.Second}}, cache.SlowestLoads(2))
+	assert.Len(t, cache.SlowestLoads(10), 3)
+	assert.Nil(t, cache.SlowestLoads(0))
+
+	// Without the option, nothing is timed.
+	cache = New(newSyncMap(), WithClock(clock))
+	load("fast", time.Millisecond)
+	assert.Nil(t, cache.LoadStats())
+	assert.Nil(t, cache.SlowestLoads(1))
+}
+
+func TestColdKeys(t *testing.T) {
+	clock := newTestClock()
+	cache := New(newSyncMap(), WithClock(clock), WithEntryTracking())
+
+	testCacheUse(t, cache, "a", "A!", true)
+	testCacheUse(t, cache, "b", "B!", true)
+	testCacheUse(t, cache, "c", "C!", true)
+	testCacheUse(t, cache, "b", "B!", false)
+	assert.Empty(t, cache.ColdKeys(time.Minute))
+
+	clock.Advance(time.Minute)
+	testCacheUse(t, cache, "d", "D!", true) // Too new to be cold
+	assert.ElementsMatch(t, []interface{}{"a", "c"}, cache.ColdKeys(time.Minute))
+
+	testCacheUse(t, cache, "a", "A!", false)
+	assert.ElementsMatch(t, []interface{}{"c"}, cache.ColdKeys(time.Minute))
+
+	// Recomputing a key resets it.
+	cache.Bust(func() {
+		testCacheUse(t, cache, "b", "B!", true)
+	})
+	clock.Advance(time.Minute)
+	assert.ElementsMatch(t, []interface{}{"b", "c", "d"}, cache.ColdKeys(time.Minute))
+}
+
+func TestRequestCache(t *testing.T) {
+	parent1, cancel1 := context.WithCancel(context.Background())
+	parent2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	ctx1, ctx2 := WithRequestCache(parent1), WithRequestCache(parent2)
+
+	cache1 := RequestCache(ctx1)
+	assert.Equal(t, cache1, RequestCache(ctx1))
+	testCacheUse(t, RequestCache(ctx1), "foo", "Foo!", true)
+	testCacheUse(t, RequestCache(ctx1), "foo", "Foo!", false)
+
+	testCacheUse(t, RequestCache(ctx2), "foo", "Other!", true)
+	testCacheUse(t, RequestCache(ctx2), "foo", "Other!", false)
+	testCacheUse(t, RequestCache(ctx1), "foo", "Foo!", false)
+
+	// Derived contexts share the cache.
+	derived, cancel := context.WithTimeout(ctx1, time.Hour)
+	defer cancel()
+	testCacheUse(t, RequestCache(derived), "foo", "Foo!", false)
+
+	// Without a cache, nothing is stored.
+	testCacheUse(t, RequestCache(parent2), "foo", "None!", true)
+	testCacheUse(t, RequestCache(parent2), "foo", "None!", true)
+
+	cancel1()
+	testCacheUse(t, RequestCache(ctx1), "foo", "Foo!", true)
+	testCacheUse(t, RequestCache(ctx1), "foo", "Foo!", true)
+	withTestTimeout(t, 500, func() {
+		for cache1.Len() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	testCacheUse(t, cache1, "foo", "Foo!", true) // Emptied
+	testCacheUse(t, RequestCache(ctx2), "foo", "Other!", false)
+}
+
+type testKeyedRequest struct {
+	UserID    int    `funcache:"key"`
+	Scope     string `funcache:"key"`
+	Timestamp time.Time
+}
+
+type keyFuncTestResource struct {
+	TenantID, ResourceID int
+	loadedAt             time.Time
+}
+
+func TestWithKeyFunc(t *testing.T) {
+	cache := NewInMemCache(WithKeyFunc(func(key interface{}) interface{} {
+		if r, ok := key.(*keyFuncTestResource); ok {
+			return fmt.Sprintf("%d/%d", r.TenantID, r.ResourceID)
+		}
+		return key
+	}))
+
+	a := &keyFuncTestResource{TenantID: 1, ResourceID: 42, loadedAt: time.Now()}
+	b := &keyFuncTestResource{TenantID: 1, ResourceID: 42}
+	testCacheUse(t, cache, a, "Resource", true)
+	testCacheUse(t, cache, b, "Resource", false) // A different pointer, but equal
+	testCacheUse(t, cache, &keyFuncTestResource{TenantID: 2, ResourceID: 42}, "Other", true)
+	testCacheUse(t, cache, "1/42", "Resource", false)
+
+	cache.Delete(b)
+	testCacheUse(t, cache, a, "Resource", true)
+	testCacheUse(t, cache, "plain", "Plain", true)
+}
+
+func TestStructKey(t *testing.T) {
+	now := time.Now()
+	req1 := testKeyedRequest{1, "read", now}
+	req2 := testKeyedRequest{1, "read", now.Add(time.Hour)}
+	req3 := testKeyedRequest{1, "write", now}
+
+	assert.Equal(t, StructKey(req1), StructKey(req2))
+	assert.Equal(t, StructKey(req1), StructKey(&req2))
+	assert.NotEqual(t, StructKey(req1), StructKey(req3))
+
+	// Different types with the same key values don't collide.
+	type otherRequest testKeyedRequest
+	assert.NotEqual(t, StructKey(req1), StructKey(otherRequest(req1)))
+
+	cache := noisyTestCache(t)
+	testCacheUse(t, cache, StructKey(req1), "Foo!", true)
+	testCacheUse(t, cache, StructKey(req2), "Foo!", false)
+	testCacheUse(t, cache, StructKey(req3), "Bar!", true)
+
+	// Interface fields can hold values that aren't comparable.
+	type anyRequest struct {
+		Scopes interface{} `funcache:"key"`
+	}
+	testCacheUse(t, cache, StructKey(anyRequest{[]string{"read"}}), "Read!", true)
+	testCacheUse(t, cache, StructKey(anyRequest{[]string{"read"}}), "Read!", false)
+	testCacheUse(t, cache, StructKey(anyRequest{[]string{"write"}}), "Write!", true)
+	testCacheUse(t, cache, StructKey(anyRequest{"read"}), "Read!", true)
+
+	assert.Panics(t, func() { StructKey("foo") })
+	assert.Panics(t, func() {
+		StructKey(struct {
+			IDs []int `funcache:"key"`
+		}{})
+	})
+	assert.Panics(t, func() {
+		StructKey(struct {
+			id int `funcache:"key"`
+		}{})
+	})
+}
+
+func TestPartitionedStore(t *testing.T) {
+	even, odd := newSyncMap(), newCopyOnWriteMap()
+	store := NewPartitionedStore([]Store{even, odd}, func(key interface{}) int {
+		return key.(int) % 2
+	})
+	cache := New(store)
+
+	for i := 0; i < 5; i++ {
+		testCacheUse(t, cache, i, i*10, true)
+	}
+	for i := 0; i < 5; i++ {
+		testCacheUse(t, cache, i, i*10, false)
+	}
+	assert.ElementsMatch(t, []interface{}{0, 2, 4}, even.Keys())
+	assert.ElementsMatch(t, []interface{}{1, 3}, odd.Keys())
+
+	assert.Equal(t, 5, store.(CountableStore).Len())
+	assert.ElementsMatch(t, []interface{}{0, 1, 2, 3, 4}, store.(EnumerableStore).Keys())
+
+	store.(RemovableStore).Remove(3)
+	assert.Equal(t, 4, store.(CountableStore).Len())
+	testCacheUse(t, cache, 3, 30, true)
+
+	assert.PanicsWithValue(t, "funcache: shard -1 for key -1 is out of range (have 2 shards)", func() {
+		cache.Cache(-1, func() interface{} { return nil })
+	})
+
+	// Only what every shard can do is supported.
+	store = NewPartitionedStore([]Store{newSyncMap(), struct{ Store }{newSyncMap()}}, func(key interface{}) int { return 0 })
+	assert.Equal(t, storeCaps(0), capsOf(store))
+}
+
+func TestExportSorted(t *testing.T) {
+	cache := NewInMemCache()
+	for _, key := range []string{"c", "a", "d", "b"} {
+		testCacheUse(t, cache, key, strings.ToUpper(key), true)
+	}
+
+	assert.ElementsMatch(t, []KeyValue{{"a", "A"}, {"b", "B"}, {"c", "C"}, {"d", "D"}}, cache.Export())
+	assert.Equal(t, []KeyValue{{"a", "A"}, {"b", "B"}, {"c", "C"}, {"d", "D"}}, cache.ExportSorted(func(a, b interface{}) bool {
+		return a.(string) < b.(string)
+	}))
+	assert.Equal(t, []KeyValue{{"d", "D"}, {"c", "C"}, {"b", "B"}, {"a", "A"}}, cache.ExportSorted(func(a, b interface{}) bool {
+		return a.(string) > b.(string)
+	}))
+	assert.Len(t, cache.ExportSorted(nil), 4)
+
+	assert.Nil(t, noisyTestCache(t).Export()) // Not enumerable
+}
+
+func TestSnapshotAndWarm(t *testing.T) {
+	for _, newStore := range []func() Store{
+		func() Store { return newSyncMap() },
+		func() Store { return newCopyOnWriteMap() },
+		func() Store { return newLRUStore(10) },
+		func() Store { return &batchTestStore{EnumerableStore: newLRUStore(10)} },
+	} {
+		cache := New(newStore())
+		testCacheUse(t, cache, "foo", "Foo!", true)
+		testCacheUse(t, cache, 42, "Answer", true)
+		snapshot := cache.Snapshot()
+		assert.Equal(t, map[interface{}]interface{}{"foo": "Foo!", 42: "Answer"}, snapshot)
+
+		warmed := New(newStore())
+		warmed.Warm(snapshot)
+		testCacheUse(t, warmed, "foo", "Foo!", false)
+		testCacheUse(t, warmed, 42, "Answer", false)
+		assert.Equal(t, snapshot, warmed.Snapshot())
+	}
+
+	// Namespaces snapshot and warm just their own keys.
+	cache := NewInMemCache()
+	testCacheUse(t, cache, "foo", "Root", true)
+	users := cache.Namespace("users")
+	testCacheUse(t, users, "foo", "Alice", true)
+	assert.Equal(t, map[interface{}]interface{}{"foo": "Alice"}, users.Snapshot())
+	cache.Namespace("copy").Warm(users.Snapshot())
+	testCacheUse(t, cache, "copy/foo", "Alice", false)
+
+	assert.Nil(t, noisyTestCache(t).Snapshot())
+}
+
+func TestWarmAndSnapshotBatches(t *testing.T) {
+	batch := &batchTestStore{EnumerableStore: newSyncMap()}
+	cache := New(batch)
+	entries := map[interface{}]interface{}{"a": "A", "b": "B", "c": "C"}
+	cache.Warm(entries)
+	assert.Equal(t, 1, batch.adds)
+	assert.Equal(t, entries, cache.Snapshot())
+	assert.Equal(t, 1, batch.gets)
+
+	// The in-memory store does batches too, under one lock.
+	var store BatchStore = newSyncMap()
+	store.AddMulti(map[interface{}]interface{}{"a": "A", 1: "One"})
+	assert.Equal(t, map[interface{}]interface{}{"a": "A", 1: "One"}, store.GetMulti([]interface{}{"a", 1, "none"}))
+	value, _ := store.Get(1)
+	assert.Equal(t, "One", value)
+
+	cache = NewInMemCache()
+	cache.Warm(entries)
+	testCacheUse(t, cache, "b", "B", false)
+	assert.Equal(t, entries, cache.Snapshot())
+}
+
+func TestRange(t *testing.T) {
+	for _, store := range []Store{newSyncMap(), newCopyOnWriteMap(), newConcurrentMap(), newLRUStore(10)} {
+		cache := New(store)
+		entries := map[interface{}]interface{}{"a": "A", "b": "B", "c": "C"}
+		cache.Warm(entries)
+
+		ranged := make(map[interface{}]interface{})
+		cache.Range(func(key, value interface{}) bool {
+			ranged[key] = value
+			return true
+		})
+		assert.Equal(t, entries, ranged)
+
+		var calls int
+		cache.Range(func(key, value interface{}) bool {
+			calls++
+			return calls < 2 // Stop early
+		})
+		assert.Equal(t, 2, calls)
+
+		// The cache can be changed along the way.
+		cache.Range(func(key, value interface{}) bool {
+			if len(key.(string)) == 1 { // Not the new ones, if we see them
+				cache.Delete(key)
+				cache.Set(key.(string)+"2", value)
+			}
+			return true
+		})
+		assert.Equal(t, "A", cache.Cache("a2", nil))
+		_, ok := cache.GetIfPresent("a")
+		assert.False(t, ok)
+	}
+
+	// Namespaces range over just their own keys.
+	cache := NewInMemCache()
+	testCacheUse(t, cache, "foo", "Root", true)
+	users := cache.Namespace("users")
+	testCacheUse(t, users, "foo", "Alice", true)
+	users.Range(func(key, value interface{}) bool {
+		assert.Equal(t, "foo", key)
+		assert.Equal(t, "Alice", value)
+		return true
+	})
+	nilCache().Range(func(key, value interface{}) bool {
+		t.Error("nothing to range over")
+		return true
+	})
+}
+
+func TestRangeWhileWriting(t *testing.T) {
+	cache := NewInMemCache()
+	for i := 0; i < 100; i++ {
+		cache.Set(i, i)
+	}
+
+	// Writes from other goroutines are safe; they just wait their turn.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 100; i < 200; i++ {
+			cache.Set(i, i)
+			cache.Delete(i - 100)
+		}
+	}()
+	for n := 0; n < 10; n++ {
+		cache.Range(func(key, value interface{}) bool {
+			assert.Equal(t, key, value)
+			return true
+		})
+	}
+	<-done
+
+	// Reading while someone waits to write is fine too.
+	cache.Range(func(key, value interface{}) bool {
+		writing := make(chan bool)
+		go func() {
+			close(writing)
+			cache.Set(key, value)
+		}()
+		<-writing
+		time.Sleep(time.Millisecond) // Let the write start waiting
+		cache.GetIfPresent(key)
+		return false
+	})
+
+	var count int
+	cache.Range(func(key, value interface{}) bool {
+		assert.True(t, key.(int) >= 100)
+		count++
+		return true
+	})
+	assert.Equal(t, 100, count)
+}
+
+// Use all the methods which store keys or values in their own forms.
+func testUseInternalEntries(cache *Cache) {
+	cache.Set("plain", "Plain!")
+	cache.Once("once", func() {})
+	cache.WrapArgs(func() interface{} { return "args" }, 1, "a")
+	cache.WrapExact(func() interface{} { return "exact" })
+	cache.Set(StructKey(testKeyedRequest{UserID: 1}), "struct")
+	cache.Set([]int{1, 2}, "unhashable")
+	cache.CacheETag("etag", func() (interface{}, string) { return "ETag!", "v1" })
+	cache.Cache2("pair", func() (interface{}, interface{}) { return "First!", 2 })
+	cache.CacheMeta("meta", map[string]interface{}{"source": "db"}, func() interface{} { return "Meta!" })
+	cache.CacheVersioned("versioned", func() (string, error) { return "v1", nil }, func() (interface{}, error) { return "Versioned!", nil })
+	cache.CacheStale("stale", time.Minute, time.Minute, func() interface{} { return "Stale!" })
+	cache.Namespace("users").Set("alice", "Alice!")
+	cache.Namespace("users").Set(42, "Answer!")
+}
+
+func TestExportLeavesOutInternals(t *testing.T) {
+	cache := NewInMemCache()
+	testUseInternalEntries(cache)
+	assert.Equal(t, map[interface{}]interface{}{
+		"plain":       "Plain!",
+		"etag":        "ETag!",
+		"pair":        []interface{}{"First!", 2},
+		"meta":        "Meta!",
+		"versioned":   "Versioned!",
+		"stale":       "Stale!",
+		"users/alice": "Alice!",
+	}, cache.Snapshot())
+	assert.Equal(t, map[interface{}]interface{}{"alice": "Alice!", 42: "Answer!"}, cache.Namespace("users").Snapshot())
+	assert.Len(t, cache.ExportSorted(nil), 7)
+
+	ranged := make(map[interface{}]interface{})
+	cache.Range(func(key, value interface{}) bool {
+		ranged[key] = value
+		return true
+	})
+	assert.Equal(t, cache.Snapshot(), ranged)
+
+	// Warming from it gives plain values, which are recomputed by the methods
+	// that need more.
+	warmed := NewInMemCache()
+	warmed.Warm(cache.Snapshot())
+	value, etag := warmed.CacheETag("etag", func() (interface{}, string) { return "New!", "v2" })
+	assert.Equal(t, "New!", value)
+	assert.Equal(t, "v2", etag)
+}
+
+type persistTestUser struct{ Name string }
+
+func TestWriteToAndReadFrom(t *testing.T) {
+	gob.Register(persistTestUser{})
+	cache := NewInMemCache()
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, 42, 3.14, true)
+	testCacheUse(t, cache, "alice", persistTestUser{"Alice"}, true)
+
+	var buf bytes.Buffer
+	n, err := cache.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	loaded := NewInMemCache()
+	m, err := loaded.ReadFrom(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, n, m)
+	testCacheUse(t, loaded, "foo", "Foo!", false)
+	testCacheUse(t, loaded, 42, 3.14, false)
+	testCacheUse(t, loaded, "alice", persistTestUser{"Alice"}, false)
+
+	// Types that aren't registered can't be written.
+	type unregistered struct{ Name string }
+	cache.Set("bob", unregistered{"Bob"})
+	_, err = cache.WriteTo(&buf)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "gob.Register")
+	}
+
+	_, err = NewInMemCache().ReadFrom(strings.NewReader("garbage"))
+	assert.Error(t, err)
+}
+
+func TestWriteToWithInternalEntries(t *testing.T) {
+	cache := NewInMemCache()
+	testUseInternalEntries(cache)
+
+	var buf bytes.Buffer
+	_, err := cache.WriteTo(&buf)
+	assert.NoError(t, err)
+	loaded := NewInMemCache()
+	_, err = loaded.ReadFrom(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, cache.Snapshot(), loaded.Snapshot())
+
+	// A namespace can be written on its own, including its non-string keys.
+	buf.Reset()
+	_, err = cache.Namespace("users").WriteTo(&buf)
+	assert.NoError(t, err)
+	_, err = loaded.Namespace("users").ReadFrom(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Answer!", loaded.Namespace("users").Cache(42, nil))
+}
+
+func TestWithMetrics(t *testing.T) {
+	metrics := &CountingMetrics{}
+	cache := New(newSyncMap(), WithMetrics(metrics), WithStats(false))
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	cache.Cache("slow", func() interface{} {
+		time.Sleep(10 * time.Millisecond)
+		return "Slow"
+	})
+	cache.Bust(func() { testCacheUse(t, cache, "foo", "Foo!", true) })
+
+	assert.Equal(t, Stats{Hits: 1, Misses: 2, Busts: 1}, metrics.Stats())
+	loads := metrics.Loads()
+	if assert.Len(t, loads, 3) {
+		assert.True(t, loads[1] >= 10*time.Millisecond)
+	}
+	assert.Equal(t, Stats{}, cache.Stats()) // Metrics work even without stats
+
+	var _ MetricsHook = NopMetrics{}
+}
+
+func TestCacheNil(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	testCacheUse(t, cache, nil, "Foo!", true)
+	testCacheUse(t, cache, nil, "Foo!", false)
+}
+
+func TestWithCacheNil(t *testing.T) {
+	var callCount int
+	getNothing := func(cache *Cache) interface{} {
+		return cache.Cache("nothing", func() interface{} {
+			callCount += 1
+			return nil
+		})
+	}
+
+	// By default, nil is cached like any other value, and is there to be found.
+	cache := NewInMemCache()
+	assert.Nil(t, getNothing(cache))
+	assert.Nil(t, getNothing(cache))
+	assert.Equal(t, 1, callCount)
+	value, ok := cache.GetIfPresent("nothing")
+	assert.True(t, ok)
+	assert.Nil(t, value)
+
+	// Without caching nil, it's recomputed each time, and the key is missing.
+	cache = NewInMemCache(WithCacheNil(false))
+	callCount = 0
+	assert.Nil(t, getNothing(cache))
+	assert.Nil(t, getNothing(cache))
+	assert.Equal(t, 2, callCount)
+	_, ok = cache.GetIfPresent("nothing")
+	assert.False(t, ok)
+	cache.Set("nothing", nil)
+	cache.Warm(map[interface{}]interface{}{"none": nil, "some": "Some!"})
+	assert.Equal(t, []interface{}{"some"}, cache.Keys())
+
+	// Other values, including typed nils, are cached as usual.
+	var none *string
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	assert.Equal(t, none, cache.Cache("typed", func() interface{} { return none }))
+	_, ok = cache.GetIfPresent("typed")
+	assert.True(t, ok)
+}
+
+func TestCacheMixedKeys(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	testCacheUse(t, cache, "abc", "Foo!", true)
+	testCacheUse(t, cache, 123, "123!", true)
+
+	testCacheUse(t, cache, "abc", "Foo!", false)
+	testCacheUse(t, cache, 123, "123!", false)
+}
+
+func TestDeferredFuncs(t *testing.T) {
+	cache := noisyTestCache(t)
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	defer testCacheUse(t, cache, "foo", "Foo!", false)
+	defer cache.Bust(func() {
+		testCacheUse(t, cache, "foo", "Foo!", true)
+	})
+}
+
+func TestBustingDepth(t *testing.T) {
+	cache := noisyTestCache(t)
+	assert.Equal(t, uint32(0), cache.bustingDepth())
+
+	func() {
+		defer cache.Bust(func() {
+			assert.Equal(t, uint32(1), cache.bustingDepth())
+		})
+		cache.Bust(func() {
+			assert.Equal(t, uint32(1), cache.bustingDepth())
+			cache.Bust(func() {
+				assert.Equal(t, uint32(2), cache.bustingDepth())
+			})
+			defer cache.Bust(func() {
+				assert.Equal(t, uint32(2), cache.bustingDepth())
+			})
+		})
+	}()
+	assert.Equal(t, uint32(0), cache.bustingDepth())
+}
+
+func TestBustPanicking(t *testing.T) {
+	cache := noisyTestCache(t)
+	testCacheUse(t, cache, "foo", "Foo!", true)
+
+	bustAndPanic := func(bust func(fn func())) (recovered interface{}) {
+		defer func() { recovered = recover() }()
+		bust(func() {
+			cache.Bust(func() {
+				assert.Equal(t, uint32(2), cache.bustingDepth())
+				panic("oops")
+			})
+		})
+		return nil
+	}
+	assert.Equal(t, "oops", bustAndPanic(cache.Bust))
+	assert.Equal(t, uint32(0), cache.bustingDepth())
+	assert.False(t, cache.IsBusting())
+	assert.Equal(t, "oops", bustAndPanic(func(fn func()) { cache.BustReason("reload", fn) }))
+	assert.Equal(t, uint32(0), cache.bustingDepth())
+	assert.Equal(t, "", cache.bustReason())
+
+	testCacheUse(t, cache, "foo", "Foo!", false) // Back to hitting the cache
+}
+
+func TestWithBusting(t *testing.T) {
+	cache := New(newSyncMap(), WithBusting(false))
+	testCacheUse(t, cache, "foo", "Foo!", true)
+
+	cache.Bust(func() {
+		assert.Equal(t, uint32(0), cache.bustingDepth())
+		assert.False(t, cache.IsBusting())
+		testCacheUse(t, cache, "foo", "Foo!", false)
+	})
+	cache.BustOnly([]interface{}{"foo"}, func() {
+		testCacheUse(t, cache, "foo", "Foo!", false)
+	})
+	cache.BustCtx(context.Background(), func(ctx context.Context) {
+		value := cache.CacheCtx(ctx, "foo", func(context.Context) interface{} { return "Again!" })
+		assert.Equal(t, "Foo!", value)
+	})
+
+	// Deleting still works, to recompute a value.
+	cache.Delete("foo")
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	assert.Equal(t, uint64(0), cache.Stats().Busts)
+}
+
+func TestBustReason(t *testing.T) {
+	var recomputed []string
+	cache := New(newSyncMap(), WithOnBustRecompute(func(key interface{}, reason string) {
+		recomputed = append(recomputed, fmt.Sprintf("%v: %s", key, reason))
+	}))
+
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "bar", "Bar!", true)
+	assert.Empty(t, recomputed)
+
+	cache.BustReason("config reload", func() {
+		testCacheUse(t, cache, "foo", "Foo!", true)
+		func() {
+			testCacheUse(t, cache, "bar", "Bar!", true)
+		}()
+		cache.BustReason("nested", func() {
+			testCacheUse(t, cache, "foo", "Foo!", true)
+		})
+	})
+	cache.Bust(func() {
+		testCacheUse(t, cache, "bar", "Bar!", true)
+	})
+	testCacheUse(t, cache, "foo", "Foo!", false)
 
-	assert.NotEqual(t, callerA, callerB)
+	assert.Equal(t, []string{
+		"foo: config reload",
+		"bar: config reload",
+		"foo: nested",
+		"bar: ",
+	}, recomputed)
+	assert.Equal(t, uint32(0), cache.bustingDepth())
 }
 
-func TestBasics(t *testing.T) {
+func TestWithOverride(t *testing.T) {
 	cache := noisyTestCache(t)
+	testCacheUse(t, cache, "foo", "Foo!", true)
 
-	var callCount int
-	getFoo := func() string {
-		return cache.Wrap(func() interface{} {
-			callCount += 1
-			return "Foo!"
-		}).(string)
-	}
+	cache.WithOverride("foo", "Fake!", func() {
+		testCacheUse(t, cache, "foo", "Fake!", false)
+		func() {
+			testCacheUse(t, cache, "foo", "Fake!", false)
+		}()
+		cache.WithOverride("foo", "Faker!", func() {
+			testCacheUse(t, cache, "foo", "Faker!", false)
+		})
+		cache.Bust(func() {
+			testCacheUse(t, cache, "foo", "Fake!", false)
+		})
+		testCacheUse(t, cache, "bar", "Bar!", true) // Other keys are untouched
 
-	assert.Equal(t, "Foo!", getFoo())
-	assert.Equal(t, 1, callCount)
+		// Other goroutines don't see the override.
+		withTestTimeout(t, 100, func() {
+			testCacheUse(t, cache, "foo", "Foo!", false)
+		})
+	})
 
-	assert.Equal(t, "Foo!", getFoo())
-	assert.Equal(t, 1, callCount)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	assert.Equal(t, int32(0), cache.overrides.active)
+}
 
-	cache.Bust(func() {
-		assert.Equal(t, "Foo!", getFoo())
-		assert.Equal(t, 2, callCount)
+func TestCycleDetection(t *testing.T) {
+	cache := New(newSyncMap(), WithCycleDetection())
 
-		assert.Equal(t, "Foo!", getFoo())
-		assert.Equal(t, 3, callCount)
+	var loop func() interface{}
+	loop = func() interface{} { return cache.Cache("loop", loop) }
+	assert.PanicsWithValue(t, "funcache: cache recursion cycle on key loop", func() {
+		cache.Cache("loop", loop)
 	})
-}
 
-func withTestTimeout(t *testing.T, millis int, fn func()) {
-	done := make(chan bool)
-	go func() {
-		fn()
-		done <- true
-	}()
-	select {
-	case <-done:
-	case <-time.After(time.Duration(millis) * time.Millisecond):
-		t.Fatal("timed out")
-	}
-}
+	// Nothing is left behind after the panic.
+	testCacheUse(t, cache, "loop", "Foo!", true)
+	testCacheUse(t, cache, "loop", "Foo!", false)
 
-func TestFibonacci(t *testing.T) {
-	cache := NewInMemCache()
+	// As is looping back through other keys.
+	var ping, pong func() interface{}
+	ping = func() interface{} { return cache.Cache("ping", pong) }
+	pong = func() interface{} { return cache.Cache("pong", ping) }
+	assert.PanicsWithValue(t, "funcache: cache recursion cycle on key ping", func() {
+		ping()
+	})
+
+	// Or through CacheContext, which loads on another goroutine.
+	ctx := context.Background()
+	var load func(ctx context.Context) (interface{}, error)
+	load = func(ctx context.Context) (interface{}, error) { return cache.CacheContext(ctx, "load", load) }
+	assert.PanicsWithValue(t, "funcache: cache recursion cycle on key load", func() {
+		cache.CacheContext(ctx, "load", load)
+	})
+
+	// Recursing through different keys is fine.
 	var fib func(k int) int
 	fib = func(k int) int {
 		if k < 2 {
@@ -142,110 +3190,123 @@ func TestFibonacci(t *testing.T) {
 		b := cache.Cache(k-2, func() interface{} { return fib(k - 2) })
 		return a.(int) + b.(int)
 	}
-	withTestTimeout(t, 500, func() { fib(36) }) // Retardedly slow without caching
+	assert.Equal(t, 55, fib(10))
 }
 
-func testCacheUse(t *testing.T, cache *Cache, key, val interface{}, bust bool) {
-	var gotBust bool
-	gotVal := cache.Cache(key, func() interface{} {
-		gotBust = true
-		return val
-	})
-	assert.Equal(t, val, gotVal)
-	assert.Equal(t, bust, gotBust)
+// Call fn from depth frames further down the stack.
+//
+//go:noinline
+func testDeepCall(depth int, fn func()) {
+	if depth <= 0 {
+		fn()
+		return
+	}
+	testDeepCall(depth-1, fn)
 }
 
-func TestNestedCachingAndBusting(t *testing.T) {
-	cache := noisyTestCache(t)
-
-	var callCount int
-	getFoo := func() interface{} {
-		return cache.Wrap(func() interface{} {
-			callCount += 1
-			return "Foo!"
-		})
-	}
-	getBar := func() interface{} {
-		return cache.Wrap(func() interface{} {
-			getFoo()
-			getFoo()
-			callCount += 1
-			return "Bar!"
-		})
-	}
+func TestWithMaxBustDepth(t *testing.T) {
+	cache := New(newSyncMap(), WithMaxBustDepth(20))
+	testCacheUse(t, cache, "foo", "Foo!", true)
 
-	assert.Equal(t, "Foo!", getFoo())
-	assert.Equal(t, 1, callCount)
+	cache.Bust(func() {
+		testDeepCall(5, func() { testCacheUse(t, cache, "foo", "Foo!", true) })
+	})
+	cache.Bust(func() {
+		testDeepCall(50, func() { testCacheUse(t, cache, "foo", "Foo!", false) }) // Too deep to see Bust
+	})
+}
 
-	assert.Equal(t, "Bar!", getBar())
-	assert.Equal(t, 2, callCount)
+func TestStats(t *testing.T) {
+	cache := noisyTestCache(t)
 
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	testCacheUse(t, cache, "foo", "Foo!", false)
 	cache.Bust(func() {
-		assert.Equal(t, "Foo!", getFoo())
-		assert.Equal(t, 3, callCount)
-
-		assert.Equal(t, "Bar!", getBar())
-		assert.Equal(t, 6, callCount)
+		testCacheUse(t, cache, "foo", "Foo!", true)
+	})
+	assert.Equal(t, Stats{Hits: 2, Misses: 1, Busts: 1}, cache.Stats())
 
-		func() {
-			assert.Equal(t, "Bar!", getBar())
-			assert.Equal(t, 9, callCount)
-		}()
+	cache.ResetStats()
+	assert.Equal(t, Stats{}, cache.Stats())
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	assert.Equal(t, Stats{Hits: 1}, cache.Stats())
+}
 
-		cache.Bust(func() {
-			assert.Equal(t, "Bar!", getBar())
-			assert.Equal(t, 12, callCount)
-		})
-	})
+func TestWithStats(t *testing.T) {
+	cache := NewInMemCache(WithStats(false))
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+	assert.Equal(t, Stats{}, cache.Stats())
 
-	assert.Equal(t, "Bar!", getBar())
-	assert.Equal(t, 12, callCount)
+	cache = NewInMemCache(WithStats(true))
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	assert.Equal(t, Stats{Misses: 1}, cache.Stats())
 }
 
-func TestBackedByAnotherStore(t *testing.T) {
-	store, err := lru.New2Q(10)
-	assert.NoError(t, err)
-	cache := New(store)
+func TestHitRatio(t *testing.T) {
+	cache := noisyTestCache(t)
+	assert.Equal(t, 0.0, cache.HitRatio())
 
 	testCacheUse(t, cache, "foo", "Foo!", true)
 	testCacheUse(t, cache, "foo", "Foo!", false)
-	testCacheUse(t, cache, "bar", "Bar!", true)
 	testCacheUse(t, cache, "foo", "Foo!", false)
-
+	testCacheUse(t, cache, "bar", "Bar!", true)
 	cache.Bust(func() {
-		testCacheUse(t, cache, "bar", "Bar!", true)
 		testCacheUse(t, cache, "foo", "Foo!", true)
 	})
+	assert.Equal(t, 0.5, cache.HitRatio())
 
-	testCacheUse(t, cache, "foo", "Foo!", false)
 	testCacheUse(t, cache, "bar", "Bar!", false)
+	testCacheUse(t, cache, "bar", "Bar!", false)
+	assert.InDelta(t, 4.0/6.0, cache.HitRatio(), 1e-9)
 }
 
-func TestCacheNil(t *testing.T) {
+func TestPublishExpvar(t *testing.T) {
 	cache := noisyTestCache(t)
+	name := fmt.Sprintf("funcache_test_%d", time.Now().UnixNano()) // Unique, for -count
+	assert.NoError(t, cache.PublishExpvar(name))
+	assert.Error(t, cache.PublishExpvar(name))
 
-	testCacheUse(t, cache, nil, "Foo!", true)
-	testCacheUse(t, cache, nil, "Foo!", false)
+	testCacheUse(t, cache, "foo", "Foo!", true)
+	testCacheUse(t, cache, "foo", "Foo!", false)
+
+	var stats Stats
+	assert.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &stats))
+	assert.Equal(t, Stats{Hits: 1, Misses: 1}, stats)
 }
 
-func TestCacheMixedKeys(t *testing.T) {
-	cache := noisyTestCache(t)
+func TestLenAndKeys(t *testing.T) {
+	for _, cache := range []*Cache{NewInMemCache(), New(newCopyOnWriteMap()), NewSyncMapCache()} {
+		assert.Equal(t, 0, cache.Len())
+		assert.Empty(t, cache.Keys())
 
-	testCacheUse(t, cache, "abc", "Foo!", true)
-	testCacheUse(t, cache, 123, "123!", true)
+		testCacheUse(t, cache, "foo", "Foo!", true)
+		testCacheUse(t, cache, "bar", "Bar!", true)
+		testCacheUse(t, cache, "foo", "Foo!", false)
+		assert.Equal(t, 2, cache.Len())
+		assert.ElementsMatch(t, []interface{}{"foo", "bar"}, cache.Keys())
+	}
 
-	testCacheUse(t, cache, "abc", "Foo!", false)
-	testCacheUse(t, cache, 123, "123!", false)
+	assert.Equal(t, 0, nilCache().Len())
+	assert.Nil(t, nilCache().Keys())
+	assert.Equal(t, 0, noisyTestCache(t).Len()) // Can't count
+	assert.Nil(t, noisyTestCache(t).Keys())
 }
 
-func TestDeferredFuncs(t *testing.T) {
-	cache := noisyTestCache(t)
+func TestTopKeys(t *testing.T) {
+	cache := New(newSyncMap(), WithAccessCounting())
 
-	testCacheUse(t, cache, "foo", "Foo!", true)
-	defer testCacheUse(t, cache, "foo", "Foo!", false)
-	defer cache.Bust(func() {
-		testCacheUse(t, cache, "foo", "Foo!", true)
-	})
+	for i, key := range []string{"a", "b", "c", "d"} {
+		for n := 0; n <= i; n++ {
+			cache.Cache(key, func() interface{} { return key })
+		}
+	}
+	assert.Equal(t, []KeyCount{{"d", 4}, {"c", 3}}, cache.TopKeys(2))
+	assert.Equal(t, []KeyCount{{"d", 4}, {"c", 3}, {"b", 2}, {"a", 1}}, cache.TopKeys(10))
+	assert.Nil(t, cache.TopKeys(0))
+
+	assert.Empty(t, NewInMemCache().TopKeys(10)) // Not counting
 }
 
 type embeddedTestCache struct{ *Cache }
@@ -298,6 +3359,7 @@ func BenchmarkUncachedPar(b *testing.B) {
 
 func BenchmarkCacheHitsMem(b *testing.B) {
 	cache := NewInMemCache()
+	b.ReportAllocs()
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		cache.Cache("xyz", func() interface{} {
@@ -305,6 +3367,24 @@ func BenchmarkCacheHitsMem(b *testing.B) {
 		})
 	}
 }
+func BenchmarkCacheHitsMemNoBusting(b *testing.B) {
+	cache := NewInMemCache(WithBusting(false))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cache.Cache("xyz", func() interface{} {
+			return "xyz"
+		})
+	}
+}
+func BenchmarkCacheValueHitsMem(b *testing.B) {
+	cache := NewInMemCache()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cache.CacheValue("xyz", "xyz")
+	}
+}
 func BenchmarkCacheHitsMemPar(b *testing.B) {
 	cache := NewInMemCache()
 	b.ResetTimer()
@@ -316,6 +3396,42 @@ func BenchmarkCacheHitsMemPar(b *testing.B) {
 		}
 	})
 }
+func BenchmarkCacheHitsMemParStats(b *testing.B) {
+	// Same as BenchmarkCacheHitsMemPar, while also reading the stats, to show
+	// what counting costs under contention.
+	cache := NewInMemCache()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for n := 0; pb.Next(); n++ {
+			cache.Cache("xyz", func() interface{} {
+				return "xyz"
+			})
+			if n%100 == 0 {
+				cache.Stats()
+			}
+		}
+	})
+}
+func BenchmarkCacheHitsSync(b *testing.B) {
+	cache := NewSyncMapCache()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cache.Cache("xyz", func() interface{} {
+			return "xyz"
+		})
+	}
+}
+func BenchmarkCacheHitsSyncPar(b *testing.B) {
+	cache := NewSyncMapCache()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.Cache("xyz", func() interface{} {
+				return "xyz"
+			})
+		}
+	})
+}
 func BenchmarkCacheHitsCow(b *testing.B) {
 	cache := New(newCopyOnWriteMap())
 	b.ResetTimer()
@@ -336,6 +3452,23 @@ func BenchmarkCacheHitsCowPar(b *testing.B) {
 		}
 	})
 }
+func benchmarkWarmup(b *testing.B, newCache func() *Cache) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		cache := newCache()
+		for key := 0; key < 10000; key++ {
+			cache.Cache(key, func() interface{} {
+				return key
+			})
+		}
+	}
+}
+func BenchmarkWarmupMem(b *testing.B) {
+	benchmarkWarmup(b, func() *Cache { return NewInMemCache() })
+}
+func BenchmarkWarmupMemSized(b *testing.B) {
+	benchmarkWarmup(b, func() *Cache { return NewInMemCacheSize(10000) })
+}
 func BenchmarkCacheMisses(b *testing.B) {
 	cache := nilCache()
 	b.ResetTimer()
@@ -356,6 +3489,69 @@ func BenchmarkCacheMissesPar(b *testing.B) {
 		}
 	})
 }
+func BenchmarkCacheColdKeyPar(b *testing.B) {
+	const numCallers = 32
+	var callCount int64
+	for n := 0; n < b.N; n++ {
+		cache := NewInMemCache()
+		start := make(chan bool)
+		var wg sync.WaitGroup
+		for i := 0; i < numCallers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				cache.Cache("xyz", func() interface{} {
+					atomic.AddInt64(&callCount, 1)
+					time.Sleep(time.Millisecond)
+					return "xyz"
+				})
+			}()
+		}
+		close(start)
+		wg.Wait()
+	}
+	b.ReportMetric(float64(callCount)/float64(b.N), "calls/op")
+}
+
+// Many callers missing on different keys at once, each taking a while to load.
+// They should all load in parallel, taking about as long as one does.
+func benchmarkCacheColdKeysPar(b *testing.B, newStore func() Store) {
+	const numCallers = 32
+	for n := 0; n < b.N; n++ {
+		cache := New(newStore())
+		start := make(chan bool)
+		var wg sync.WaitGroup
+		for i := 0; i < numCallers; i++ {
+			wg.Add(1)
+			go func(key int) {
+				defer wg.Done()
+				<-start
+				cache.Cache(key, func() interface{} {
+					time.Sleep(time.Millisecond)
+					return key
+				})
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+	}
+}
+func BenchmarkCacheColdKeysParMem(b *testing.B) {
+	benchmarkCacheColdKeysPar(b, func() Store { return newSyncMap() })
+}
+func BenchmarkCacheColdKeysParCow(b *testing.B) {
+	benchmarkCacheColdKeysPar(b, func() Store { return newCopyOnWriteMap() })
+}
+func BenchmarkCopyOnWriteMapAddPar(b *testing.B) {
+	store := newCopyOnWriteMap()
+	var next int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			store.Add(atomic.AddInt64(&next, 1)%1000, "xyz")
+		}
+	})
+}
 func BenchmarkCacheBusted(b *testing.B) {
 	cache := nilCache()
 	b.ResetTimer()
@@ -429,6 +3625,73 @@ func BenchmarkCacheBustedCowPar(b *testing.B) {
 	})
 }
 
+// Keep another goroutine busting the cache (or a context) for the rest of the
+// benchmark, while others read from it.
+func benchmarkHitsWhileBusting(b *testing.B, cache *Cache, bust func(fn func()), get func()) {
+	get() // Warm up
+	busting, done := make(chan bool), make(chan bool)
+	go bust(func() {
+		busting <- true
+		<-done
+	})
+	<-busting
+	defer close(done)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			get()
+		}
+	})
+}
+func BenchmarkCacheHitsWhileBusting(b *testing.B) {
+	cache := NewInMemCache()
+	benchmarkHitsWhileBusting(b, cache, cache.Bust, func() {
+		cache.Cache("xyz", func() interface{} { return "xyz" })
+	})
+}
+func BenchmarkCacheHitsWhileBustingNoBusting(b *testing.B) {
+	cache := NewInMemCache(WithBusting(false))
+	benchmarkHitsWhileBusting(b, cache, cache.Bust, func() {
+		cache.Cache("xyz", func() interface{} { return "xyz" })
+	})
+}
+func BenchmarkCacheCtxHitsWhileBusting(b *testing.B) {
+	cache := NewInMemCache()
+	ctx := context.Background()
+	bust := func(fn func()) { cache.BustCtx(ctx, func(context.Context) { fn() }) }
+	benchmarkHitsWhileBusting(b, cache, bust, func() {
+		cache.CacheCtx(ctx, "xyz", func(context.Context) interface{} { return "xyz" })
+	})
+}
+func BenchmarkCacheCtxHitsWhileBustingByStack(b *testing.B) {
+	cache := NewInMemCache()
+	ctx := context.Background()
+	benchmarkHitsWhileBusting(b, cache, cache.Bust, func() {
+		cache.CacheCtx(ctx, "xyz", func(context.Context) interface{} { return "xyz" })
+	})
+}
+func BenchmarkCacheCtxHitsWhileBustingWithContextBusting(b *testing.B) {
+	cache := NewInMemCache(WithContextBusting())
+	ctx := context.Background()
+	benchmarkHitsWhileBusting(b, cache, cache.Bust, func() {
+		cache.CacheCtx(ctx, "xyz", func(context.Context) interface{} { return "xyz" })
+	})
+}
+func benchmarkDeepHitsWhileBusting(b *testing.B, opts ...Option) {
+	cache := NewInMemCache(opts...)
+	benchmarkHitsWhileBusting(b, cache, cache.Bust, func() {
+		testDeepCall(200, func() {
+			cache.Cache("xyz", func() interface{} { return "xyz" })
+		})
+	})
+}
+func BenchmarkDeepHitsWhileBusting(b *testing.B) {
+	benchmarkDeepHitsWhileBusting(b)
+}
+func BenchmarkDeepHitsWhileBustingMaxDepth(b *testing.B) {
+	benchmarkDeepHitsWhileBusting(b, WithMaxBustDepth(16))
+}
+
 func BenchmarkWrapHitsMem(b *testing.B) {
 	cache := NewInMemCache()
 	b.ResetTimer()
@@ -447,6 +3710,27 @@ func BenchmarkWrapHitsCow(b *testing.B) {
 		})
 	}
 }
+func BenchmarkWrapHitsSync(b *testing.B) {
+	cache := NewSyncMapCache()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cache.Wrap(func() interface{} {
+			return "xyz"
+		})
+	}
+}
+func BenchmarkGetFnName(b *testing.B) {
+	fn := func() interface{} { return "xyz" }
+	for n := 0; n < b.N; n++ {
+		getFnName(fn)
+	}
+}
+func BenchmarkGetFnNameUncached(b *testing.B) {
+	fn := func() interface{} { return "xyz" }
+	for n := 0; n < b.N; n++ {
+		lookupFnName(reflect.ValueOf(fn).Pointer())
+	}
+}
 func BenchmarkWrapMisses(b *testing.B) {
 	cache := nilCache()
 	b.ResetTimer()
@@ -0,0 +1,114 @@
+// Package funcachetest provides helpers for testing code which uses funcache,
+// such as a store which records what's done to it.
+package funcachetest
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Call is one call made to a RecordingStore.
+type Call struct {
+	Op    string      // "Add", "Get", "Remove" or "Purge"
+	Key   interface{} // Unset for Purge
+	Value interface{} // The value added, or found by Get
+	Found bool        // Whether Get found a value
+}
+
+// String formats the call like "Add(foo, Foo!)" or "Get(foo) -> (Foo!, true)",
+// which makes for readable test failures.
+func (c Call) String() string {
+	switch c.Op {
+	case "Add":
+		return fmt.Sprintf("Add(%v, %v)", c.Key, c.Value)
+	case "Get":
+		return fmt.Sprintf("Get(%v) -> (%v, %v)", c.Key, c.Value, c.Found)
+	case "Purge":
+		return "Purge()"
+	}
+	return fmt.Sprintf("%s(%v)", c.Op, c.Key)
+}
+
+// RecordingStore is an in-memory funcache.Store which records every Add, Get,
+// Remove and Purge made to it, in order, so that tests can check how their
+// code uses the cache (e.g. that a value was computed once, then found). Use
+// it with funcache.New. The zero value is ready to use, and it's safe for
+// concurrent access.
+//
+// Keys and values are recorded as the store sees them, so keys include any
+// namespace prefix, and values with a TTL are wrapped up by the cache. Keys
+// must be comparable (so not slices, for example).
+type RecordingStore struct {
+	mu    sync.Mutex
+	m     map[interface{}]interface{}
+	calls []Call
+}
+
+// Add stores the value under the key, and records the call.
+func (rs *RecordingStore) Add(key, value interface{}) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.m == nil {
+		rs.m = make(map[interface{}]interface{})
+	}
+	rs.m[key] = value
+	rs.calls = append(rs.calls, Call{Op: "Add", Key: key, Value: value})
+}
+
+// Get returns the value stored under the key, if there is one, and records the
+// call along with what it found.
+func (rs *RecordingStore) Get(key interface{}) (value interface{}, ok bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	value, ok = rs.m[key]
+	rs.calls = append(rs.calls, Call{Op: "Get", Key: key, Value: value, Found: ok})
+	return
+}
+
+// Remove deletes the value stored under the key, and records the call.
+func (rs *RecordingStore) Remove(key interface{}) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.m, key)
+	rs.calls = append(rs.calls, Call{Op: "Remove", Key: key})
+}
+
+// Purge deletes all the values stored, and records the call.
+func (rs *RecordingStore) Purge() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.m = nil
+	rs.calls = append(rs.calls, Call{Op: "Purge"})
+}
+
+// Len returns the number of values stored. It isn't recorded.
+func (rs *RecordingStore) Len() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.m)
+}
+
+// Keys returns the keys stored, in no particular order. It isn't recorded.
+func (rs *RecordingStore) Keys() []interface{} {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	keys := make([]interface{}, 0, len(rs.m))
+	for key := range rs.m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Calls returns all the calls recorded so far, oldest first.
+func (rs *RecordingStore) Calls() []Call {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]Call(nil), rs.calls...)
+}
+
+// Reset forgets the calls recorded so far, keeping the values stored.
+func (rs *RecordingStore) Reset() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.calls = nil
+}
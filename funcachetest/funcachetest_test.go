@@ -0,0 +1,90 @@
+package funcachetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aviddiviner/go-funcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingStore(t *testing.T) {
+	var store RecordingStore
+	store.Add("foo", "Foo!")
+	value, ok := store.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "Foo!", value)
+	store.Remove("foo")
+	_, ok = store.Get("foo")
+	assert.False(t, ok)
+	store.Add("bar", 42)
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, []interface{}{"bar"}, store.Keys())
+	store.Purge()
+	assert.Equal(t, 0, store.Len())
+
+	assert.Equal(t, []Call{
+		{Op: "Add", Key: "foo", Value: "Foo!"},
+		{Op: "Get", Key: "foo", Value: "Foo!", Found: true},
+		{Op: "Remove", Key: "foo"},
+		{Op: "Get", Key: "foo"},
+		{Op: "Add", Key: "bar", Value: 42},
+		{Op: "Purge"},
+	}, store.Calls())
+	assert.Equal(t, []string{
+		"Add(foo, Foo!)",
+		"Get(foo) -> (Foo!, true)",
+		"Remove(foo)",
+		"Get(foo) -> (<nil>, false)",
+		"Add(bar, 42)",
+		"Purge()",
+	}, callStrings(store.Calls()))
+
+	store.Reset()
+	assert.Empty(t, store.Calls())
+}
+
+func TestRecordingStoreWithCache(t *testing.T) {
+	store := &RecordingStore{}
+	cache := funcache.New(store)
+	assert.Implements(t, (*funcache.RemovableStore)(nil), store)
+	assert.Implements(t, (*funcache.PurgeableStore)(nil), store)
+	assert.Implements(t, (*funcache.EnumerableStore)(nil), store)
+
+	cache.Cache("foo", func() interface{} { return "Foo!" })
+	cache.Cache("foo", func() interface{} { return "Foo!" })
+	cache.Delete("foo")
+	cache.Clear()
+	assert.Equal(t, []string{
+		"Get(foo) -> (<nil>, false)",
+		"Add(foo, Foo!)",
+		"Get(foo) -> (Foo!, true)",
+		"Remove(foo)",
+		"Purge()",
+	}, callStrings(store.Calls()))
+}
+
+func callStrings(calls []Call) []string {
+	var strs []string
+	for _, call := range calls {
+		strs = append(strs, call.String())
+	}
+	return strs
+}
+
+func loadConfig() interface{} { return "config" }
+
+func ExampleRecordingStore() {
+	store := &RecordingStore{}
+	cache := funcache.New(store)
+
+	cache.Wrap(loadConfig)
+	cache.Wrap(loadConfig)
+	for _, call := range store.Calls() {
+		fmt.Println(call)
+	}
+	// Output:
+	// Get(github.com/aviddiviner/go-funcache/funcachetest.loadConfig) -> (<nil>, false)
+	// Add(github.com/aviddiviner/go-funcache/funcachetest.loadConfig, config)
+	// Get(github.com/aviddiviner/go-funcache/funcachetest.loadConfig) -> (config, true)
+}
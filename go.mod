@@ -0,0 +1,20 @@
+module github.com/aviddiviner/go-funcache
+
+go 1.21
+
+require (
+	github.com/dgraph-io/ristretto v0.1.1
+	github.com/hashicorp/golang-lru v0.5.4
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.0.0-20221010170243-090e33056c14 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,26 @@
+package funcache
+
+// KV is a plain key-value store, as expected by many other libraries.
+type KV interface {
+	Get(key interface{}) (value interface{}, ok bool)
+	Set(key, value interface{})
+}
+
+// AsKV returns a view of the cache as a plain key-value store. Values are set
+// with Set, as if they'd been computed, and got with GetIfPresent, returning
+// ok=false for keys that aren't there (or have expired).
+func (cache *Cache) AsKV() KV {
+	return kvView{cache}
+}
+
+type kvView struct {
+	cache *Cache
+}
+
+func (kv kvView) Get(key interface{}) (value interface{}, ok bool) {
+	return kv.cache.GetIfPresent(key)
+}
+
+func (kv kvView) Set(key, value interface{}) {
+	kv.cache.Set(key, value)
+}
@@ -0,0 +1,67 @@
+package funcache
+
+// NewLoadingStore returns a store which loads values into the inner store when
+// they're missing. Whenever a Get misses, loader is called with the key; if it
+// returns ok, the value is added to the inner store and returned, as if it had
+// been there all along. This puts the loading in the store itself, so that any
+// code sharing the store gets it, not just callers of Cache. Concurrent misses
+// for the same key share one call to loader.
+//
+// Values are stored just as loader returns them, without any TTL (even if the
+// cache has a default one), and are passed to no hooks. When used under a
+// Cache, loader is passed keys as they're stored (e.g. with any namespace
+// prefix). Removing, purging, counting and listing keys are supported if the
+// inner store supports them.
+func NewLoadingStore(inner Store, loader func(key interface{}) (interface{}, bool)) Store {
+	return withCaps(&loadingStore{inner: inner, loader: loader}, capsOf(inner))
+}
+
+// -----------------------------------------------------------------------------
+// Store which loads missing values, safe for concurrent access (as long as the
+// inner store and loader are).
+
+type loadingStore struct {
+	inner  Store
+	loader func(key interface{}) (interface{}, bool)
+	calls  callGroup
+}
+
+// What a call to the loader returned.
+type loaded struct {
+	value interface{}
+	ok    bool
+}
+
+func (ls *loadingStore) Add(key, value interface{}) {
+	ls.inner.Add(key, value)
+}
+
+func (ls *loadingStore) Get(key interface{}) (value interface{}, ok bool) {
+	if value, ok = ls.inner.Get(key); ok {
+		return
+	}
+	result := ls.calls.do(normalizeKey(key), true, func() interface{} {
+		value, ok := ls.loader(key)
+		if ok {
+			ls.inner.Add(key, value)
+		}
+		return loaded{value, ok}
+	}).(loaded)
+	return result.value, result.ok
+}
+
+func (ls *loadingStore) Remove(key interface{}) {
+	ls.inner.(RemovableStore).Remove(key)
+}
+
+func (ls *loadingStore) Purge() {
+	ls.inner.(PurgeableStore).Purge()
+}
+
+func (ls *loadingStore) Len() int {
+	return ls.inner.(CountableStore).Len()
+}
+
+func (ls *loadingStore) Keys() []interface{} {
+	return ls.inner.(EnumerableStore).Keys()
+}
@@ -0,0 +1,49 @@
+package funcache
+
+// NewLoggingStore returns a store which logs every Add, Get, Remove and Purge
+// through logf (e.g. log.Printf, or t.Logf in tests) and passes it on to the
+// inner store. Adds and removes are logged before they're made; gets are logged
+// once they return, along with what was found. This helps to find out why keys
+// are missing. Removing, purging, counting and listing keys are supported if
+// the inner store supports them.
+func NewLoggingStore(inner Store, logf func(format string, args ...interface{})) Store {
+	return withCaps(&loggingStore{inner: inner, logf: logf}, capsOf(inner))
+}
+
+// -----------------------------------------------------------------------------
+// Store which logs what's done to it, safe for concurrent access (as long as
+// the inner store and logf are).
+
+type loggingStore struct {
+	inner Store
+	logf  func(format string, args ...interface{})
+}
+
+func (ls *loggingStore) Add(key, value interface{}) {
+	ls.logf("funcache: Add(%v, %v)", key, value)
+	ls.inner.Add(key, value)
+}
+
+func (ls *loggingStore) Get(key interface{}) (value interface{}, ok bool) {
+	value, ok = ls.inner.Get(key)
+	ls.logf("funcache: Get(%v) -> (%v, %v)", key, value, ok)
+	return
+}
+
+func (ls *loggingStore) Remove(key interface{}) {
+	ls.logf("funcache: Remove(%v)", key)
+	ls.inner.(RemovableStore).Remove(key)
+}
+
+func (ls *loggingStore) Purge() {
+	ls.logf("funcache: Purge()")
+	ls.inner.(PurgeableStore).Purge()
+}
+
+func (ls *loggingStore) Len() int {
+	return ls.inner.(CountableStore).Len()
+}
+
+func (ls *loggingStore) Keys() []interface{} {
+	return ls.inner.(EnumerableStore).Keys()
+}
@@ -0,0 +1,157 @@
+package funcache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// NewLRUCache returns a Cache backed by an in-memory store that holds at most
+// maxEntries values. When it's full, the least recently used entry is evicted.
+// Both storing and looking up a value count as using it. It returns an error if
+// maxEntries isn't positive.
+func NewLRUCache(maxEntries int, opts ...Option) (*Cache, error) {
+	if maxEntries < 1 {
+		return nil, errors.New("funcache: maxEntries must be positive")
+	}
+	return New(newLRUStore(maxEntries), opts...), nil
+}
+
+// NewSizedCache returns a Cache backed by an in-memory store that holds values
+// up to a total of maxBytes, as measured by sizeOf. When adding a value takes
+// the total over, the least recently used entries are evicted until it fits.
+// Values bigger than maxBytes on their own aren't stored at all. sizeOf is
+// passed values as they were cached, without anything the cache wraps them in.
+// It returns an error if maxBytes isn't positive, or sizeOf is nil.
+func NewSizedCache(maxBytes int64, sizeOf func(value interface{}) int64, opts ...Option) (*Cache, error) {
+	if maxBytes < 1 {
+		return nil, errors.New("funcache: maxBytes must be positive")
+	}
+	if sizeOf == nil {
+		return nil, errors.New("funcache: sizeOf must not be nil")
+	}
+	store := newLRUStore(0)
+	store.maxBytes, store.sizeOf = maxBytes, sizeOf
+	return New(store, opts...), nil
+}
+
+// -----------------------------------------------------------------------------
+// Bounded store, evicting the least recently used, safe for concurrent access.
+// It's bounded by the number of entries, or by their total size (if sizeOf is
+// set), or both.
+
+type lruStore struct {
+	sync.Mutex // Needed even for Get, which moves entries
+	maxEntries int
+	items      map[interface{}]*list.Element
+	order      *list.List // Most recently used at the front
+
+	maxBytes, bytes int64
+	sizeOf          func(value interface{}) int64
+
+	onEvict func(key, value interface{}) // Called without the lock held
+}
+
+type lruItem struct {
+	key, value interface{}
+	size       int64
+}
+
+func newLRUStore(maxEntries int) *lruStore {
+	return &lruStore{
+		maxEntries: maxEntries,
+		items:      make(map[interface{}]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func (ls *lruStore) Add(key, value interface{}) {
+	key = normalizeKey(key)
+	var size int64
+	if ls.sizeOf != nil {
+		size = ls.sizeOf(unwrapEntry(unexpire(value)))
+	}
+	evicted, onEvict := ls.add(key, value, size)
+	if onEvict != nil {
+		for _, item := range evicted {
+			onEvict(item.key, item.value)
+		}
+	}
+}
+
+// Add the item, returning any evicted to make room for it, and who to tell.
+func (ls *lruStore) add(key, value interface{}, size int64) (evicted []*lruItem, onEvict func(key, value interface{})) {
+	ls.Lock()
+	defer ls.Unlock()
+	if elem, ok := ls.items[key]; ok {
+		ls.remove(elem)
+	}
+	if ls.sizeOf != nil && size > ls.maxBytes {
+		return nil, nil // Would never fit
+	}
+	ls.items[key] = ls.order.PushFront(&lruItem{key, value, size})
+	ls.bytes += size
+	for (ls.maxEntries > 0 && ls.order.Len() > ls.maxEntries) || (ls.sizeOf != nil && ls.bytes > ls.maxBytes) {
+		evicted = append(evicted, ls.remove(ls.order.Back()))
+	}
+	return evicted, ls.onEvict
+}
+
+// Remove an entry, keeping count of the size.
+func (ls *lruStore) remove(elem *list.Element) *lruItem {
+	item := ls.order.Remove(elem).(*lruItem)
+	delete(ls.items, item.key)
+	ls.bytes -= item.size
+	return item
+}
+
+func (ls *lruStore) SetEvictCallback(fn func(key, value interface{})) {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.onEvict = fn
+}
+
+func (ls *lruStore) Get(key interface{}) (value interface{}, ok bool) {
+	key = normalizeKey(key)
+	ls.Lock()
+	defer ls.Unlock()
+	if elem, ok := ls.items[key]; ok {
+		ls.order.MoveToFront(elem)
+		return elem.Value.(*lruItem).value, true
+	}
+	return nil, false
+}
+
+func (ls *lruStore) Remove(key interface{}) {
+	key = normalizeKey(key)
+	ls.Lock()
+	defer ls.Unlock()
+	if elem, ok := ls.items[key]; ok {
+		ls.remove(elem)
+	}
+}
+
+func (ls *lruStore) Purge() {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.items = make(map[interface{}]*list.Element)
+	ls.order.Init()
+	ls.bytes = 0
+}
+
+func (ls *lruStore) Len() int {
+	ls.Lock()
+	defer ls.Unlock()
+	return ls.order.Len()
+}
+
+// Keys are listed from most to least recently used.
+func (ls *lruStore) Keys() []interface{} {
+	ls.Lock()
+	defer ls.Unlock()
+	keys := make([]interface{}, 0, ls.order.Len())
+	for elem := ls.order.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*lruItem).key)
+	}
+	return keys
+}
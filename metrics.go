@@ -0,0 +1,65 @@
+package funcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsHook receives live cache activity, as it happens, e.g. to update
+// Prometheus counters and histograms. Set one on a cache WithMetrics. Every
+// lookup calls exactly one of IncHit, IncMiss or IncBust, as with Stats, and
+// every time a value is computed, ObserveLoad is called with how long it took.
+//
+// The methods are called while caching, so they should be quick, and must be
+// safe for concurrent use.
+type MetricsHook interface {
+	IncHit()
+	IncMiss()
+	IncBust()
+	ObserveLoad(d time.Duration)
+}
+
+// NopMetrics is a MetricsHook which does nothing. It's handy for embedding, to
+// implement only some of the methods.
+type NopMetrics struct{}
+
+func (NopMetrics) IncHit()                   {}
+func (NopMetrics) IncMiss()                  {}
+func (NopMetrics) IncBust()                  {}
+func (NopMetrics) ObserveLoad(time.Duration) {}
+
+// CountingMetrics is a MetricsHook which just counts everything, in process.
+// It's mostly useful for tests. The zero value is ready to use.
+type CountingMetrics struct {
+	hits, misses, busts uint64
+
+	mu    sync.Mutex
+	loads []time.Duration
+}
+
+func (cm *CountingMetrics) IncHit()  { atomic.AddUint64(&cm.hits, 1) }
+func (cm *CountingMetrics) IncMiss() { atomic.AddUint64(&cm.misses, 1) }
+func (cm *CountingMetrics) IncBust() { atomic.AddUint64(&cm.busts, 1) }
+
+func (cm *CountingMetrics) ObserveLoad(d time.Duration) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.loads = append(cm.loads, d)
+}
+
+// Stats returns the counts of hits, misses and busts so far.
+func (cm *CountingMetrics) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadUint64(&cm.hits),
+		Misses: atomic.LoadUint64(&cm.misses),
+		Busts:  atomic.LoadUint64(&cm.busts),
+	}
+}
+
+// Loads returns how long each load took, in the order they finished.
+func (cm *CountingMetrics) Loads() []time.Duration {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return append([]time.Duration(nil), cm.loads...)
+}
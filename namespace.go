@@ -0,0 +1,84 @@
+package funcache
+
+import "strings"
+
+// Namespace returns a view of the cache in which every key is prefixed with the
+// given prefix and a slash, so that keys in different namespaces can't clash.
+// The view shares everything else with the cache: its store, busting (so Bust
+// works the same in both) and stats. Methods that take keys, like Delete, only
+// affect keys in the namespace, as do Clear, Export, Snapshot and Range.
+// Namespaces can be nested.
+//
+// Other methods which look at the whole store, like Len and Keys, see all the
+// keys, with their prefixes.
+func (cache *Cache) Namespace(prefix string) *Cache {
+	return &Cache{cacheState: cache.cacheState, namespace: cache.namespace + prefix + "/"}
+}
+
+// Keys in a namespace which aren't strings, so can't simply be prefixed.
+type namespacedKey struct {
+	namespace string
+	key       interface{}
+}
+
+// Scope the key to the cache's namespace, if it has one. Keys are passed through
+// the key func first, if there is one, and any which can't be used as map keys
+// are normalized too.
+func (cache *Cache) scope(key interface{}) interface{} {
+	if cache.keyFunc != nil {
+		key = cache.keyFunc(key)
+	}
+	key = normalizeKey(key)
+	if cache.namespace == "" {
+		return key
+	}
+	if s, ok := key.(string); ok {
+		return cache.namespace + s
+	}
+	return namespacedKey{cache.namespace, key}
+}
+
+// Whether a key from the store is in the cache's namespace.
+func (cache *Cache) inNamespace(key interface{}) bool {
+	_, ok := cache.unscope(key)
+	return ok
+}
+
+// Return the key from the store without the cache's namespace, if it's in it.
+func (cache *Cache) unscope(key interface{}) (interface{}, bool) {
+	if cache.namespace == "" {
+		return key, true
+	}
+	switch k := key.(type) {
+	case string:
+		if strings.HasPrefix(k, cache.namespace) {
+			return k[len(cache.namespace):], true
+		}
+	case namespacedKey:
+		if k.namespace == cache.namespace {
+			return k.key, true
+		}
+		if strings.HasPrefix(k.namespace, cache.namespace) {
+			return namespacedKey{k.namespace[len(cache.namespace):], k.key}, true
+		}
+	}
+	return nil, false
+}
+
+// Remove all the values in the cache's namespace.
+func (cache *Cache) clearNamespace() {
+	store, ok := cache.store.(RemovableStore)
+	if !ok {
+		return
+	}
+	keys, ok := cache.store.(EnumerableStore)
+	if !ok {
+		return
+	}
+	for _, key := range keys.Keys() {
+		if cache.inNamespace(key) {
+			store.Remove(key)
+		}
+	}
+	cache.entries.deleteIf(func(key interface{}, _ *entryInfo) bool { return cache.inNamespace(key) })
+}
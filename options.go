@@ -0,0 +1,233 @@
+package funcache
+
+import (
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+// Option configures a Cache. Pass any number of them to New.
+type Option func(*Cache)
+
+// WithCycleDetection makes the cache watch for recursive computations that
+// loop back on themselves. If a function being cached for some key ends up
+// calling Cache for that same key (directly or through other keys, on the same
+// goroutine, or on the one loading for CacheContext), it panics with a clear
+// message. Without this, it would wait on itself forever.
+//
+// This has to track which keys each goroutine is computing, which adds some
+// overhead to every cache miss, so it's best used while debugging.
+func WithCycleDetection() Option {
+	return func(cache *Cache) { cache.detectCycles = true }
+}
+
+// WithClock sets the clock used to expire cached values. The default is the
+// system clock.
+func WithClock(clock Clock) Option {
+	return func(cache *Cache) { cache.clock = clock }
+}
+
+// WithDefaultTTL makes values expire after the given duration, unless they're
+// cached with a TTL of their own (e.g. by CacheWithTTL). The default is for
+// values never to expire.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(cache *Cache) { cache.defaultTTL = ttl }
+}
+
+// WithStats turns the counting of hits, misses and busts (for Stats) on or off.
+// It's on by default; turning it off saves a little work on every lookup.
+func WithStats(enabled bool) Option {
+	return func(cache *Cache) { cache.noStats = !enabled }
+}
+
+// WithMinRecomputeInterval limits how often any key can be recomputed. Once a
+// value is computed, it's returned for at least the given duration, even when
+// busting or after it's expired. This protects a fragile backend from being
+// hammered by aggressive busting.
+//
+// The time each key was last computed is kept in memory for the life of the
+// cache.
+func WithMinRecomputeInterval(d time.Duration) Option {
+	return func(cache *Cache) { cache.minRecompute = d }
+}
+
+// WithAccessCounting makes the cache count how many times each key is looked
+// up, so that the hottest keys can be found with TopKeys. The counts are kept
+// in memory for the life of the cache.
+func WithAccessCounting() Option {
+	return func(cache *Cache) { cache.countAccess = true }
+}
+
+// WithLoadTiming makes the cache time how long each value takes to compute, by
+// the cache's clock, so that the most expensive keys can be found with
+// LoadStats and SlowestLoads. Only the last load of each key is kept, in memory
+// for the life of the cache.
+func WithLoadTiming() Option {
+	return func(cache *Cache) { cache.timeLoads = true }
+}
+
+// WithEntryTracking makes the cache keep track of when each value is stored,
+// and how many times it's been hit since. Old entries can then be purged with
+// PurgeOlderThan, and unused ones found with ColdKeys. This is kept in memory
+// for the life of the cache.
+func WithEntryTracking() Option {
+	return func(cache *Cache) { cache.trackEntries = true }
+}
+
+// WithOnProgress sets a hook which is passed any partial results reported by
+// functions being cached with CacheProgress, along with their key.
+func WithOnProgress(fn func(key, partial interface{})) Option {
+	return func(cache *Cache) { cache.onProgress = fn }
+}
+
+// WithTypeGuard makes the cache check that values found in the store are of the
+// expected type (or assignable to it). Any that aren't are treated as missing,
+// and recomputed, rather than being returned to panic in the caller's type
+// assertion. This is useful with external stores, where values might have been
+// written by something else. See also WithOnTypeMismatch.
+func WithTypeGuard(expected reflect.Type) Option {
+	return func(cache *Cache) { cache.typeGuard = expected }
+}
+
+// WithOnTypeMismatch sets a hook which is called with any values found in the
+// store that don't match the type guard, along with their key.
+func WithOnTypeMismatch(fn func(key, value interface{})) Option {
+	return func(cache *Cache) { cache.onTypeMismatch = fn }
+}
+
+// WithOnBustRecompute sets a hook which is called whenever a value is going to
+// be recomputed because of busting. It's passed the key, and the reason given
+// to BustReason (or "" for a plain Bust).
+func WithOnBustRecompute(fn func(key interface{}, reason string)) Option {
+	return func(cache *Cache) { cache.onBustRecompute = fn }
+}
+
+// WithNonBlockingHotKeys stops lookups from waiting on a value that's already
+// being computed by someone else. If there's a stale value stored for the key
+// (e.g. one that's expired), it's returned right away instead. This trades some
+// staleness for not piling up goroutines behind a slow recompute of a hot key.
+func WithNonBlockingHotKeys() Option {
+	return func(cache *Cache) { cache.nonBlockingHotKeys = true }
+}
+
+// WithOnReplace sets a hook which is called whenever a value is stored for a
+// key that already had one (e.g. when it's recomputed because of busting, or
+// after expiring), with the old and new values. This lets the old value release
+// any resources it holds. It's called after the store is updated, and outside
+// of any locks held by the cache.
+func WithOnReplace(fn func(key, oldValue, newValue interface{})) Option {
+	return func(cache *Cache) { cache.onReplace = fn }
+}
+
+// WithOnAdd sets a hook which is called whenever a value is stored, after it's
+// been added to the store.
+func WithOnAdd(fn func(key, value interface{})) Option {
+	return func(cache *Cache) { cache.onAdd = fn }
+}
+
+// WithOnEvict sets a hook which is called whenever the store evicts a value by
+// itself, such as an LRU store making room for others. The store has to be an
+// EvictNotifier for this to work, like those made by NewLRUCache and
+// NewSizedCache; otherwise the hook is never called. It's called with the key
+// as it's stored (i.e. with any namespace prefix).
+func WithOnEvict(fn func(key, value interface{})) Option {
+	return func(cache *Cache) { cache.onEvict = fn }
+}
+
+// WithOnHit sets a hook which is called whenever a value is found in the cache,
+// instead of being computed.
+func WithOnHit(fn func(key, value interface{})) Option {
+	return func(cache *Cache) { cache.onHit = fn }
+}
+
+// WithOnMiss sets a hook which is called whenever a value isn't found in the
+// cache (or is being busted), before it's computed.
+func WithOnMiss(fn func(key interface{})) Option {
+	return func(cache *Cache) { cache.onMiss = fn }
+}
+
+// WithNegativeTTL makes ErrNotFound values expire, rather than be kept forever
+// like any other value. Each one is kept for the base duration, plus a random
+// amount up to the jitter, so that missing keys aren't looked up constantly,
+// but also don't all get looked up again at the same moment. This applies even
+// to values cached with their own TTL, like by CacheWithTTL, so a missing key
+// can be cached briefly while a found one is kept for longer. CacheErr caches a
+// returned ErrNotFound error, too.
+func WithNegativeTTL(base, jitter time.Duration) Option {
+	return func(cache *Cache) { cache.negativeTTL, cache.negativeJitter = base, jitter }
+}
+
+// WithTTLJitter randomly spreads out the TTLs given to CacheWithTTL (and
+// CacheTTLFunc), by up to the given fraction either way; e.g. with 0.1, a TTL
+// of a minute becomes anywhere from 54 to 66 seconds. This way, values loaded
+// at the same moment don't all expire and get recomputed at the same moment
+// too. Each value's expiry is picked once, when it's stored. The fraction
+// should be less than 1.
+func WithTTLJitter(fraction float64) Option {
+	return func(cache *Cache) { cache.ttlJitter = fraction }
+}
+
+// WithCacheNil(false) makes the cache leave out nil values, rather than storing
+// them like any other. A function which returns nil is then called again next
+// time, as if it had failed, and setting a key to nil (e.g. with Set or Warm)
+// stores nothing. Typed nils, like a nil pointer in an interface, aren't nil,
+// so are still stored. The default is true.
+func WithCacheNil(enabled bool) Option {
+	return func(cache *Cache) { cache.noCacheNil = !enabled }
+}
+
+// WithRandSource sets the source of randomness used for jitter. The default is
+// seeded from the current time.
+func WithRandSource(src rand.Source) Option {
+	return func(cache *Cache) { cache.rand.r = rand.New(src) }
+}
+
+// WithBusting(false) turns busting off, for caches whose values never need
+// recomputing. Bust, BustOnly and BustCtx then just call their functions, and
+// lookups don't spend any time checking whether they're being busted, even
+// while someone calls Bust. The default is true.
+func WithBusting(enabled bool) Option {
+	return func(cache *Cache) { cache.noBusting = !enabled }
+}
+
+// WithContextBusting makes CacheCtx and CacheContext take busting only from
+// their contexts (see BustCtx), rather than also checking whether they were
+// called from within Bust. They never walk the stack then, so they stay fast
+// while other goroutines are busting. Bust still busts Cache, Wrap and the rest.
+func WithContextBusting() Option {
+	return func(cache *Cache) { cache.ctxBustingOnly = true }
+}
+
+// WithMaxBustDepth limits how far up the stack to look for a call to Bust, to at
+// most n frames. While anyone is busting, every call to Cache has to look, and
+// for deep stacks that can be slow. But if Bust was called further up than the
+// limit, values won't be busted as they should be, so n should be comfortably
+// more than the depth of any nested caching. The default is no limit.
+func WithMaxBustDepth(n int) Option {
+	return func(cache *Cache) { cache.maxBustDepth = n }
+}
+
+// WithCopyOnGet makes Cache (and Wrap, CacheLoad, WrapHit, GetIfPresent and
+// TypedCache) return copyFn(value) rather than the cached value itself, on hits
+// and misses alike. So if the value is mutable, like a slice or a pointer to a
+// struct, callers can change their copy without changing what's cached for
+// everyone else. The default is to return the cached value as is.
+func WithCopyOnGet(copyFn func(value interface{}) interface{}) Option {
+	return func(cache *Cache) { cache.copyOnGet = copyFn }
+}
+
+// WithKeyFunc passes every key given to the cache through keyFunc, and uses
+// what it returns instead, for both storing and looking up values. This lets
+// keys which aren't equal as they are, but should be, share a value; e.g.
+// pointers to equal structs, flattened to a string like "tenant/42". The keys
+// that Wrap assigns go through it too. The default is to use keys as they are.
+func WithKeyFunc(keyFunc func(key interface{}) interface{}) Option {
+	return func(cache *Cache) { cache.keyFunc = keyFunc }
+}
+
+// WithMetrics reports cache activity to the given hook as it happens, such as
+// hits, misses and how long each value takes to compute. Without it, there's
+// no cost.
+func WithMetrics(hook MetricsHook) Option {
+	return func(cache *Cache) { cache.metrics = hook }
+}
@@ -0,0 +1,61 @@
+package funcache
+
+import "fmt"
+
+// NewPartitionedStore returns a store which spreads keys across the given
+// shards (e.g. separate Redis instances), storing each key in the shard at the
+// index returned by shardOf. It panics if shardOf returns an index out of
+// range. Removing, purging, counting and listing keys are supported only if
+// every shard supports them.
+func NewPartitionedStore(shards []Store, shardOf func(key interface{}) int) Store {
+	return withCaps(&partitionedStore{shards: shards, shardOf: shardOf}, capsOf(shards...))
+}
+
+// -----------------------------------------------------------------------------
+// Store split over shards, safe for concurrent access (as long as the shards
+// are).
+
+type partitionedStore struct {
+	shards  []Store
+	shardOf func(key interface{}) int
+}
+
+func (ps *partitionedStore) shard(key interface{}) Store {
+	i := ps.shardOf(key)
+	if i < 0 || i >= len(ps.shards) {
+		panic(fmt.Sprintf("funcache: shard %d for key %v is out of range (have %d shards)", i, key, len(ps.shards)))
+	}
+	return ps.shards[i]
+}
+
+func (ps *partitionedStore) Add(key, value interface{}) {
+	ps.shard(key).Add(key, value)
+}
+
+func (ps *partitionedStore) Get(key interface{}) (value interface{}, ok bool) {
+	return ps.shard(key).Get(key)
+}
+
+func (ps *partitionedStore) Remove(key interface{}) {
+	ps.shard(key).(RemovableStore).Remove(key)
+}
+
+func (ps *partitionedStore) Purge() {
+	for _, shard := range ps.shards {
+		shard.(PurgeableStore).Purge()
+	}
+}
+
+func (ps *partitionedStore) Len() (n int) {
+	for _, shard := range ps.shards {
+		n += shard.(CountableStore).Len()
+	}
+	return
+}
+
+func (ps *partitionedStore) Keys() (keys []interface{}) {
+	for _, shard := range ps.shards {
+		keys = append(keys, shard.(EnumerableStore).Keys()...)
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package funcache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// WriteTo saves a snapshot of the cache to w, gob-encoded, so that it can be
+// loaded again later with ReadFrom (e.g. by a command-line tool that runs often
+// and wants to start warm). It returns the number of bytes written.
+//
+// Keys and values are encoded as interfaces, so their concrete types must be
+// registered with gob.Register (basic types like strings and ints already are)
+// and must have exported fields. Otherwise this returns an error, and nothing
+// useful is written. The store must be an EnumerableStore, as with Export.
+//
+// What's written is what Export returns, so entries under keys the cache made
+// up itself (like those of WrapArgs or Once) are skipped, and values lose any
+// extra information stored with them, such as CacheETag's ETags.
+func (cache *Cache) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	if err := gob.NewEncoder(cw).Encode(cache.Export()); err != nil {
+		return cw.n, fmt.Errorf("funcache: encoding snapshot (are all types registered with gob.Register?): %w", err)
+	}
+	return cw.n, nil
+}
+
+// ReadFrom loads a snapshot saved by WriteTo from r, storing every entry in the
+// cache as Warm does. The types of keys and values must be registered with
+// gob.Register, as for WriteTo. It returns the number of bytes read.
+func (cache *Cache) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	var entries []KeyValue
+	if err := gob.NewDecoder(cr).Decode(&entries); err != nil {
+		return cr.n, fmt.Errorf("funcache: decoding snapshot: %w", err)
+	}
+	for _, entry := range entries {
+		cache.Set(entry.Key, entry.Value)
+	}
+	return cr.n, nil
+}
+
+func init() {
+	gob.Register([]interface{}(nil)) // How Export gives pairs from Cache2
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
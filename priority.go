@@ -0,0 +1,150 @@
+package funcache
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+)
+
+// NewPriorityCache returns a Cache backed by an in-memory store that holds at
+// most maxEntries values. When it's full, the entry with the lowest priority
+// is evicted (the oldest one, when priorities tie). Priorities are worked out
+// by calling priorityOf as values are added, so any eviction policy you like
+// can be expressed, regardless of how recently or often entries are used. It's
+// passed values as they were cached, without anything the cache wraps them in.
+// It returns an error if maxEntries isn't positive, or priorityOf is nil.
+func NewPriorityCache(maxEntries int, priorityOf func(key, value interface{}) int, opts ...Option) (*Cache, error) {
+	if maxEntries < 1 {
+		return nil, errors.New("funcache: maxEntries must be positive")
+	}
+	if priorityOf == nil {
+		return nil, errors.New("funcache: priorityOf must not be nil")
+	}
+	return New(newPriorityStore(maxEntries, priorityOf), opts...), nil
+}
+
+// -----------------------------------------------------------------------------
+// Bounded store, evicting by priority, safe for concurrent access.
+
+type priorityStore struct {
+	sync.Mutex
+	maxEntries int
+	priorityOf func(key, value interface{}) int
+	items      map[interface{}]*priorityItem
+	queue      priorityQueue
+	seq        uint64
+}
+
+type priorityItem struct {
+	key, value interface{}
+	priority   int
+	seq        uint64 // Order added, to break ties
+	index      int    // Position in the queue
+}
+
+func newPriorityStore(maxEntries int, priorityOf func(key, value interface{}) int) *priorityStore {
+	return &priorityStore{
+		maxEntries: maxEntries,
+		priorityOf: priorityOf,
+		items:      make(map[interface{}]*priorityItem),
+	}
+}
+
+func (ps *priorityStore) Add(key, value interface{}) {
+	priority := ps.priorityOf(key, unwrapEntry(unexpire(value)))
+	key = normalizeKey(key)
+	ps.Lock()
+	defer ps.Unlock()
+	ps.seq++
+	if item, ok := ps.items[key]; ok {
+		item.value = value
+		item.priority = priority
+		item.seq = ps.seq
+		heap.Fix(&ps.queue, item.index)
+		return
+	}
+	item := &priorityItem{key: key, value: value, priority: priority, seq: ps.seq}
+	ps.items[key] = item
+	heap.Push(&ps.queue, item)
+	if len(ps.queue) > ps.maxEntries {
+		evicted := heap.Pop(&ps.queue).(*priorityItem)
+		delete(ps.items, evicted.key)
+	}
+}
+
+func (ps *priorityStore) Get(key interface{}) (value interface{}, ok bool) {
+	key = normalizeKey(key)
+	ps.Lock()
+	defer ps.Unlock()
+	if item, ok := ps.items[key]; ok {
+		return item.value, true
+	}
+	return nil, false
+}
+
+func (ps *priorityStore) Remove(key interface{}) {
+	key = normalizeKey(key)
+	ps.Lock()
+	defer ps.Unlock()
+	if item, ok := ps.items[key]; ok {
+		heap.Remove(&ps.queue, item.index)
+		delete(ps.items, key)
+	}
+}
+
+func (ps *priorityStore) Purge() {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.items = make(map[interface{}]*priorityItem)
+	ps.queue = nil
+}
+
+func (ps *priorityStore) Len() int {
+	ps.Lock()
+	defer ps.Unlock()
+	return len(ps.queue)
+}
+
+// Keys are listed in no particular order.
+func (ps *priorityStore) Keys() []interface{} {
+	ps.Lock()
+	defer ps.Unlock()
+	keys := make([]interface{}, 0, len(ps.queue))
+	for _, item := range ps.queue {
+		keys = append(keys, item.key)
+	}
+	return keys
+}
+
+// Min-heap of items, implementing heap.Interface.
+type priorityQueue []*priorityItem
+
+func (pq priorityQueue) Len() int { return len(pq) }
+
+func (pq priorityQueue) Less(i, j int) bool {
+	if pq[i].priority == pq[j].priority {
+		return pq[i].seq < pq[j].seq
+	}
+	return pq[i].priority < pq[j].priority
+}
+
+func (pq priorityQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *priorityQueue) Push(x interface{}) {
+	item := x.(*priorityItem)
+	item.index = len(*pq)
+	*pq = append(*pq, item)
+}
+
+func (pq *priorityQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*pq = old[:n-1]
+	return item
+}
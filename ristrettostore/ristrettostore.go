@@ -0,0 +1,76 @@
+// Package ristrettostore provides a funcache.Store backed by Ristretto, a
+// fast, bounded cache with cost-based admission and eviction.
+//
+// It lives in its own package so that funcache itself doesn't depend on
+// Ristretto.
+package ristrettostore
+
+import (
+	"github.com/aviddiviner/go-funcache"
+	"github.com/dgraph-io/ristretto"
+)
+
+type store struct {
+	cache *ristretto.Cache
+	cost  int64
+}
+
+// NewRistrettoStore returns a store backed by a new Ristretto cache, with the
+// given config. Use it with funcache.New.
+//
+// Values are added with a cost of 1, unless the config has a Cost func, in
+// which case that's used to work out the cost of each value.
+//
+// Ristretto's writes are asynchronous, and may be dropped under contention or
+// rejected by its admission policy. The store waits for each write to be
+// applied before returning, but there's no guarantee a value will be there
+// when next looked up; it's only ever a cache miss, though.
+//
+// Ristretto only takes keys which are strings, byte slices or integers. Keys of
+// any other type are stored under their funcache.HashKey.
+func NewRistrettoStore(cfg *ristretto.Config) (funcache.Store, error) {
+	cache, err := ristretto.NewCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &store{cache: cache, cost: 1}
+	if cfg.Cost != nil {
+		s.cost = 0 // Ristretto calls cfg.Cost for us
+	}
+	return s, nil
+}
+
+// FromCache returns a store backed by an existing Ristretto cache, such as one
+// that's shared with other code. Values are added with the given cost; a cost
+// of 0 means the cache's Cost func is used instead, as with Ristretto's Set.
+// The same caveats apply as for NewRistrettoStore.
+func FromCache(cache *ristretto.Cache, cost int64) funcache.Store {
+	return &store{cache: cache, cost: cost}
+}
+
+// Ristretto only takes keys of some types, so any others (including funcache's
+// own, like from WrapArgs or Namespace) are stored under their hash.
+func storeKey(key interface{}) interface{} {
+	switch key.(type) {
+	case uint64, string, []byte, byte, int, int32, uint32, int64:
+		return key
+	}
+	return funcache.HashKey(key)
+}
+
+func (s *store) Add(key, value interface{}) {
+	s.cache.Set(storeKey(key), value, s.cost)
+	s.cache.Wait()
+}
+
+func (s *store) Get(key interface{}) (value interface{}, ok bool) {
+	return s.cache.Get(storeKey(key))
+}
+
+func (s *store) Remove(key interface{}) {
+	s.cache.Del(storeKey(key))
+}
+
+func (s *store) Purge() {
+	s.cache.Clear()
+}
@@ -0,0 +1,127 @@
+package ristrettostore
+
+import (
+	"testing"
+
+	"github.com/aviddiviner/go-funcache"
+	"github.com/dgraph-io/ristretto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaching(t *testing.T) {
+	store, err := NewRistrettoStore(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	assert.NoError(t, err)
+	cache := funcache.New(store)
+
+	var callCount int
+	getFoo := func() interface{} {
+		return cache.Cache("foo", func() interface{} {
+			callCount += 1
+			return "Foo!"
+		})
+	}
+	assert.Equal(t, "Foo!", getFoo())
+	assert.Equal(t, "Foo!", getFoo())
+	assert.Equal(t, 1, callCount)
+
+	store.(funcache.RemovableStore).Remove("foo")
+	assert.Equal(t, "Foo!", getFoo())
+	assert.Equal(t, 2, callCount)
+}
+
+func TestWrapFromCache(t *testing.T) {
+	rc, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	assert.NoError(t, err)
+	cache := funcache.New(FromCache(rc, 1))
+
+	var callCount int
+	foo := func() interface{} {
+		callCount += 1
+		return "Foo!"
+	}
+	assert.Equal(t, "Foo!", cache.Wrap(foo))
+	assert.Equal(t, "Foo!", cache.Wrap(foo))
+	assert.Equal(t, 1, callCount)
+
+	// The value is in the shared cache, under the key Wrap uses.
+	value, ok := rc.Get(funcache.KeyForFunc(foo))
+	assert.True(t, ok)
+	assert.Equal(t, "Foo!", value)
+
+	cache.Bust(func() {
+		assert.Equal(t, "Foo!", cache.Wrap(foo))
+	})
+	assert.Equal(t, 2, callCount)
+}
+
+func TestOtherKeys(t *testing.T) {
+	store, err := NewRistrettoStore(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	assert.NoError(t, err)
+	cache := funcache.New(store)
+
+	var callCount int
+	getUser := func(id int, tags []string) interface{} {
+		return cache.WrapArgs(func() interface{} {
+			callCount += 1
+			return id
+		}, id, tags)
+	}
+	assert.Equal(t, 1, getUser(1, []string{"a"}))
+	assert.Equal(t, 1, getUser(1, []string{"a"}))
+	assert.Equal(t, 2, getUser(2, []string{"a"}))
+	assert.Equal(t, 2, callCount)
+
+	users := cache.Namespace("users")
+	assert.Equal(t, "Alice", users.Cache(42, func() interface{} { return "Alice" }))
+	assert.Equal(t, "Alice", users.Cache(42, nil))
+	assert.Equal(t, "Bob", users.Cache("bob", func() interface{} { return "Bob" }))
+	users.Delete(42)
+	assert.Equal(t, "Alice?", users.Cache(42, func() interface{} { return "Alice?" }))
+
+	type point struct{ X, Y int }
+	cache.Set(point{1, 2}, "Point!")
+	assert.Equal(t, "Point!", cache.Cache(point{1, 2}, nil))
+	type request struct {
+		ID int `funcache:"key"`
+	}
+	cache.Set(funcache.StructKey(request{7}), "Struct!")
+	assert.Equal(t, "Struct!", cache.Cache(funcache.StructKey(request{7}), nil))
+}
+
+func TestEviction(t *testing.T) {
+	store, err := NewRistrettoStore(&ristretto.Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		store.Add(i, i)
+	}
+	var found int
+	for i := 0; i < 100; i++ {
+		if _, ok := store.Get(i); ok {
+			found++
+		}
+	}
+	assert.True(t, found <= 10, "found %d entries", found)
+}
+
+func TestBadConfig(t *testing.T) {
+	_, err := NewRistrettoStore(&ristretto.Config{})
+	assert.Error(t, err)
+}
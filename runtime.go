@@ -1,57 +1,145 @@
 package funcache
 
 import (
+	"bytes"
 	"reflect"
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 const cacheBustingFn = "github.com/aviddiviner/go-funcache.(*Cache).Bust"
 
 var cacheBustingFnPc uintptr
 
-// Return the program counters of function invocations all the way up the stack.
-func getAllCallers(skip int) (pcs []uintptr) {
-	// Arbitrarily do this in batches of 64
-	var batch = make([]uintptr, 64)
-	var n int
-	for {
-		n = runtime.Callers(skip, batch)
-		pcs = append(pcs, batch[:n]...)
-		if n < len(batch) {
+// Check if any of the callers were our cache busting function, looking at no
+// more than maxDepth of them (or all of them, if it's zero or less).
+func wasCalledByCacheBustingFn(maxDepth int) bool {
+	// Skip the first 2 callers:
+	// 1. runtime.Callers
+	// 2. github.com/aviddiviner/go-funcache.wasCalledByCacheBustingFn
+	//
+	// From there on it should be:
+	// 3. github.com/aviddiviner/go-funcache.(*Cache).isBusting
+	// ...
+	var batch [64]uintptr
+	for skip, seen := 2, 0; maxDepth <= 0 || seen < maxDepth; {
+		pcs := batch[:]
+		if maxDepth > 0 && maxDepth-seen < len(pcs) {
+			pcs = pcs[:maxDepth-seen]
+		}
+		n := runtime.Callers(skip, pcs)
+		for _, pc := range pcs[:n] {
+			if pc == cacheBustingFnPc {
+				return true
+			}
+		}
+		if n < len(pcs) {
 			break
 		}
 		skip += n
+		seen += n
 	}
-	return
+	return false
 }
 
-// Check if any of the callers were our cache busting function.
-func wasCalledByCacheBustingFn() bool {
-	// Skip the first 3 callers:
-	// 1. runtime.Callers
-	// 2. github.com/aviddiviner/funcache.getAllCallers
-	// 3. github.com/aviddiviner/funcache.wasCalledByCacheBustingFn
-	//
-	// From there on it should be:
-	// 4. github.com/aviddiviner/funcache.(*Cache).Cache
-	// ...
-	pcs := getAllCallers(3)
-	for _, pc := range pcs {
-		if pc == cacheBustingFnPc {
-			return true
+// Return the ID of the current goroutine, parsed from the first line of its
+// stack trace ("goroutine 123 [running]:"). This is slow, so only use it when
+// a feature has been opted into.
+func getGoroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	b := bytes.TrimPrefix(buf[:n], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// Stacks of values kept for each goroutine, safe for concurrent access. While
+// they're all empty, looking up the current goroutine's stack is cheap.
+type goroutineStacks struct {
+	active int32 // Number of values on all stacks
+	mu     sync.Mutex
+	m      map[uint64][]interface{}
+}
+
+// Push a value onto the current goroutine's stack. The returned func pops it.
+func (gs *goroutineStacks) push(value interface{}) (pop func()) {
+	gid := getGoroutineID()
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.m == nil {
+		gs.m = make(map[uint64][]interface{})
+	}
+	gs.m[gid] = append(gs.m[gid], value)
+	atomic.AddInt32(&gs.active, 1)
+	return func() {
+		gs.mu.Lock()
+		defer gs.mu.Unlock()
+		stack := gs.m[gid]
+		if len(stack) == 1 {
+			delete(gs.m, gid)
+		} else {
+			gs.m[gid] = stack[:len(stack)-1]
 		}
+		atomic.AddInt32(&gs.active, -1)
 	}
-	return false
 }
 
-func getFnName(fn func() interface{}) string {
+// Return the current goroutine's stack, bottom first. Only the goroutine that
+// owns a stack changes it, so it's safe to read without copying.
+func (gs *goroutineStacks) current() []interface{} {
+	if atomic.LoadInt32(&gs.active) == 0 {
+		return nil
+	}
+	gid := getGoroutineID()
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.m[gid]
+}
+
+// Return the source file and line of a caller, like "/path/to/file.go:123".
+// Skip is as for runtime.Caller, counting the caller of getCallSite as 1.
+func getCallSite(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	return file + ":" + strconv.Itoa(line)
+}
+
+// Names of functions, by entry PC. A function's name never changes, so there's
+// no need to look it up more than once.
+var fnNames sync.Map
+
+func getFnName(fn interface{}) string {
 	ptr := reflect.ValueOf(fn).Pointer()
+	if ptr == 0 {
+		panic(ErrNilLoader.Error())
+	}
+	if name, ok := fnNames.Load(ptr); ok {
+		return name.(string)
+	}
+	name := lookupFnName(ptr)
+	fnNames.Store(ptr, name)
+	return name
+}
+
+func lookupFnName(ptr uintptr) string {
 	return runtime.FuncForPC(ptr).Name()
 }
 
 func init() {
 	nilCache().Bust(func() {
-		cacheBustingFnPc, _, _, _ = runtime.Caller(1)
+		// Use the same kind of PC (a return address) as wasCalledByCacheBustingFn
+		// gets, so that they compare equal. The one from runtime.Caller is off
+		// by one.
+		var pcs [1]uintptr
+		runtime.Callers(2, pcs[:])
+		cacheBustingFnPc = pcs[0]
 	})
 	// Sanity check that we have the right cache busting function
 	fn := runtime.FuncForPC(cacheBustingFnPc)
@@ -0,0 +1,180 @@
+package funcache
+
+import "sort"
+
+// KeyValue is a key, and the value cached under it.
+type KeyValue struct {
+	Key, Value interface{}
+}
+
+// Export returns all the unexpired entries in the cache, in no particular
+// order. For a namespaced view, only the entries in the namespace are returned,
+// without their prefix. The store must be an EnumerableStore; otherwise this
+// returns nothing.
+//
+// Only the keys and values you gave are returned. Values stored with extra
+// information, like by CacheETag, CacheMeta, CacheVersioned or CacheStale, are
+// returned without it; pairs stored by Cache2 are returned as a two-element
+// []interface{}. Entries under keys that the cache made up itself are left out:
+// those of WrapArgs, WrapExact and Once, keys made by StructKey, keys which
+// aren't hashable (like slices), and non-string keys in a Namespace (export the
+// namespace itself to get those).
+func (cache *Cache) Export() []KeyValue {
+	stored := cache.storedData()
+	if stored == nil {
+		return nil
+	}
+	entries := make([]KeyValue, 0, len(stored))
+	for key, data := range stored {
+		if key, value, ok := cache.exported(key, data); ok {
+			entries = append(entries, KeyValue{key, value})
+		}
+	}
+	return entries
+}
+
+// Return the key and value as they're exported, from the key and data in the
+// store, if they are.
+func (cache *Cache) exported(key, data interface{}) (interface{}, interface{}, bool) {
+	key, ok := cache.unscope(key)
+	if !ok || isInternalKey(key) {
+		return nil, nil, false
+	}
+	value, ok := cache.unwrap(data)
+	if !ok {
+		return nil, nil, false
+	}
+	return key, unwrapEntry(value), true
+}
+
+// Return the value held by any entry the cache wrapped it in, to store along
+// with it (other than for expiry; see unexpire).
+func unwrapEntry(value interface{}) interface{} {
+	switch entry := value.(type) {
+	case etagEntry:
+		return entry.value
+	case metaEntry:
+		return entry.value
+	case versionEntry:
+		return entry.value
+	case staleEntry:
+		return entry.value
+	case pairEntry:
+		return []interface{}{entry.first, entry.second}
+	}
+	return value
+}
+
+// Whether the key was made up by the cache, rather than given to it.
+func isInternalKey(key interface{}) bool {
+	switch key.(type) {
+	case argsKey, exactFnKey, onceKey, structKey, unhashableKey, namespacedKey:
+		return true
+	}
+	return false
+}
+
+// Snapshot is the same as Export, but returns the entries as a map. It can be
+// passed to Warm, to load the entries back into a cache. Any extra information
+// stored with values is lost on the way, so methods like CacheETag compute
+// those values again.
+func (cache *Cache) Snapshot() map[interface{}]interface{} {
+	entries := cache.Export()
+	if entries == nil {
+		return nil
+	}
+	snapshot := make(map[interface{}]interface{}, len(entries))
+	for _, entry := range entries {
+		snapshot[entry.Key] = entry.Value
+	}
+	return snapshot
+}
+
+// Range calls fn for each unexpired entry in the cache, in no particular order,
+// until it returns false, like sync.Map's Range. Unlike Export or Snapshot, it
+// doesn't build a map of the entries first, so it suits large caches, e.g. to
+// render them on a debug page. For a namespaced view, only the entries in the
+// namespace are ranged over, without their prefix. The store must be an
+// EnumerableStore; otherwise this does nothing.
+//
+// No store locks are held while fn is called, so fn can read and write the
+// cache as it likes. As with sync.Map, entries added or removed during Range
+// may or may not be seen. Entries are given as Export returns them.
+func (cache *Cache) Range(fn func(key, value interface{}) bool) {
+	cache.rangeData(func(key, data interface{}) bool {
+		if key, value, ok := cache.exported(key, data); ok {
+			return fn(key, value)
+		}
+		return true
+	})
+}
+
+// Warm stores all the given entries in the cache, as if they'd been computed,
+// e.g. from a Snapshot taken earlier. This saves the first callers from waiting
+// on values that are already known. If the store is a BatchStore, they're all
+// added at once.
+func (cache *Cache) Warm(entries map[interface{}]interface{}) {
+	values := make(map[interface{}]interface{}, len(entries))
+	for key, value := range entries {
+		values[cache.resolve(key)] = value
+	}
+	cache.addMulti(values)
+}
+
+// Stores which can take a consistent copy of all their data at once. The map
+// returned mustn't be modified.
+type snapshotter interface {
+	snapshot() map[interface{}]interface{}
+}
+
+// Stores which can go through all their data without copying it.
+type ranger interface {
+	rangeData(fn func(key, data interface{}) bool)
+}
+
+// Call fn with the data stored for each key, until it returns false. Stores
+// which can't range over their data by themselves have their keys listed, and
+// each key got in turn.
+func (cache *Cache) rangeData(fn func(key, data interface{}) bool) {
+	if store, ok := cache.store.(ranger); ok {
+		store.rangeData(fn)
+		return
+	}
+	store, ok := cache.store.(EnumerableStore)
+	if !ok {
+		return
+	}
+	for _, key := range store.Keys() {
+		if data, ok := store.Get(key); ok && !fn(key, data) {
+			return
+		}
+	}
+}
+
+// Return all the data in the store, by key, as consistently as the store
+// allows. It's nil if the store can't list its keys.
+func (cache *Cache) storedData() map[interface{}]interface{} {
+	if store, ok := cache.store.(snapshotter); ok {
+		return store.snapshot()
+	}
+	store, ok := cache.store.(EnumerableStore)
+	if !ok {
+		return nil
+	}
+	keys := store.Keys()
+	if len(keys) == 0 {
+		return map[interface{}]interface{}{}
+	}
+	return cache.getMulti(keys)
+}
+
+// ExportSorted is the same as Export, but the entries are sorted by key, using
+// the given less func. This gives a stable order, e.g. for comparing against
+// golden files. With a nil less func, the order is unspecified.
+func (cache *Cache) ExportSorted(less func(a, b interface{}) bool) []KeyValue {
+	entries := cache.Export()
+	if less != nil {
+		sort.Slice(entries, func(i, j int) bool { return less(entries[i].Key, entries[j].Key) })
+	}
+	return entries
+}
@@ -0,0 +1,248 @@
+package funcache
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counters of cache activity. Every call to Cache counts as
+// exactly one of a hit, a miss or a bust.
+type Stats struct {
+	Hits   uint64 `json:"hits"`   // Values returned from the store
+	Misses uint64 `json:"misses"` // Values not found in the store, and computed
+	Busts  uint64 `json:"busts"`  // Values recomputed because of a Bust
+
+	NegativeHits uint64 `json:"negativeHits"` // Hits which returned ErrNotFound (also counted in Hits)
+}
+
+// Stats returns a snapshot of the cache's activity counters.
+func (cache *Cache) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadUint64(&cache.hits),
+		Misses: atomic.LoadUint64(&cache.misses),
+		Busts:  atomic.LoadUint64(&cache.busts),
+
+		NegativeHits: atomic.LoadUint64(&cache.negativeHits),
+	}
+}
+
+// ResetStats sets all the cache's activity counters back to zero.
+func (cache *Cache) ResetStats() {
+	atomic.StoreUint64(&cache.hits, 0)
+	atomic.StoreUint64(&cache.misses, 0)
+	atomic.StoreUint64(&cache.busts, 0)
+	atomic.StoreUint64(&cache.negativeHits, 0)
+}
+
+// HitRatio returns the proportion of lookups which were hits, out of all hits
+// and misses (busts aren't counted). It's 0 if there haven't been any yet.
+func (cache *Cache) HitRatio() float64 {
+	stats := cache.Stats()
+	if stats.Hits+stats.Misses == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+}
+
+// Guards against racing publishes of the same name, which would make expvar
+// panic.
+var expvarMu sync.Mutex
+
+// PublishExpvar publishes the cache's Stats with the expvar package, under the
+// given name. They're then served as JSON at /debug/vars, along with any other
+// published variables. It returns an error if the name is already in use.
+func (cache *Cache) PublishExpvar(name string) error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("funcache: expvar %q is already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} { return cache.Stats() }))
+	return nil
+}
+
+// Len returns the number of entries in the store, including any that have
+// expired but not yet been removed. The store must be a CountableStore;
+// otherwise it's 0.
+func (cache *Cache) Len() int {
+	if store, ok := cache.store.(CountableStore); ok {
+		return store.Len()
+	}
+	return 0
+}
+
+// Keys returns a snapshot of the keys in the store, in no particular order.
+// The store must be an EnumerableStore; otherwise it's nil.
+func (cache *Cache) Keys() []interface{} {
+	if store, ok := cache.store.(EnumerableStore); ok {
+		return store.Keys()
+	}
+	return nil
+}
+
+// KeyCount is a key, and the number of times it's been accessed.
+type KeyCount struct {
+	Key   interface{}
+	Count uint64
+}
+
+// TopKeys returns the n most accessed keys, with their access counts, most
+// accessed first. Accesses are only counted if the cache was created with
+// WithAccessCounting; otherwise this returns nothing.
+func (cache *Cache) TopKeys(n int) []KeyCount {
+	if n <= 0 {
+		return nil
+	}
+	var counts []KeyCount
+	cache.accessCounts.Range(func(key, count interface{}) bool {
+		counts = append(counts, KeyCount{key, atomic.LoadUint64(count.(*uint64))})
+		return true
+	})
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Count > counts[j].Count })
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// LoadStats returns how long the last load of each key took, by key. Loads are
+// only timed if the cache was created WithLoadTiming; otherwise this returns
+// nothing.
+func (cache *Cache) LoadStats() map[interface{}]time.Duration {
+	return cache.loadTimes.snapshot()
+}
+
+// KeyDuration is a key, and how long it took to load.
+type KeyDuration struct {
+	Key      interface{}
+	Duration time.Duration
+}
+
+// SlowestLoads returns the n keys which took longest to load (the last time
+// they were), slowest first. As with LoadStats, the cache must have been
+// created WithLoadTiming; otherwise this returns nothing.
+func (cache *Cache) SlowestLoads(n int) []KeyDuration {
+	if n <= 0 {
+		return nil
+	}
+	var loads []KeyDuration
+	for key, d := range cache.loadTimes.snapshot() {
+		loads = append(loads, KeyDuration{key, d})
+	}
+	sort.Slice(loads, func(i, j int) bool { return loads[i].Duration > loads[j].Duration })
+	if len(loads) > n {
+		loads = loads[:n]
+	}
+	return loads
+}
+
+// ColdKeys returns the keys of entries which have been in the cache for at
+// least minAge, but haven't been hit since they were stored. These are values
+// that aren't paying for their keep. The cache must have been created
+// WithEntryTracking; otherwise this returns nothing.
+func (cache *Cache) ColdKeys(minAge time.Duration) []interface{} {
+	now := cache.clock.Now()
+	var keys []interface{}
+	cache.entries.RLock()
+	defer cache.entries.RUnlock()
+	for key, info := range cache.entries.m {
+		if now.Sub(info.createdAt) >= minAge && atomic.LoadUint64(&info.hits) == 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// -----------------------------------------------------------------------------
+// Counters for any number of keys, safe for concurrent access.
+
+type counterMap struct{ sync.Map }
+
+func (cm *counterMap) inc(key interface{}) {
+	count, ok := cm.Load(key)
+	if !ok {
+		count, _ = cm.LoadOrStore(key, new(uint64))
+	}
+	atomic.AddUint64(count.(*uint64), 1)
+}
+
+// -----------------------------------------------------------------------------
+// Map of keys to durations, safe for concurrent access.
+
+type durationMap struct {
+	sync.Mutex
+	m map[interface{}]time.Duration
+}
+
+func (dm *durationMap) set(key interface{}, d time.Duration) {
+	dm.Lock()
+	defer dm.Unlock()
+	if dm.m == nil {
+		dm.m = make(map[interface{}]time.Duration)
+	}
+	dm.m[key] = d
+}
+
+func (dm *durationMap) snapshot() map[interface{}]time.Duration {
+	dm.Lock()
+	defer dm.Unlock()
+	if dm.m == nil {
+		return nil
+	}
+	m := make(map[interface{}]time.Duration, len(dm.m))
+	for k, v := range dm.m {
+		m[k] = v
+	}
+	return m
+}
+
+// -----------------------------------------------------------------------------
+// Info about each entry stored, safe for concurrent access.
+
+type entryTable struct {
+	sync.RWMutex
+	m map[interface{}]*entryInfo
+}
+
+type entryInfo struct {
+	hits      uint64 // Since stored; first, for alignment
+	createdAt time.Time
+}
+
+func (et *entryTable) add(key interface{}, at time.Time) {
+	et.Lock()
+	defer et.Unlock()
+	if et.m == nil {
+		et.m = make(map[interface{}]*entryInfo)
+	}
+	et.m[key] = &entryInfo{createdAt: at}
+}
+
+func (et *entryTable) hit(key interface{}) {
+	et.RLock()
+	defer et.RUnlock()
+	if info, ok := et.m[key]; ok {
+		atomic.AddUint64(&info.hits, 1)
+	}
+}
+
+func (et *entryTable) delete(key interface{}) {
+	et.Lock()
+	defer et.Unlock()
+	delete(et.m, key)
+}
+
+// Delete all the entries for which fn returns true.
+func (et *entryTable) deleteIf(fn func(key interface{}, info *entryInfo) bool) {
+	et.Lock()
+	defer et.Unlock()
+	for key, info := range et.m {
+		if fn(key, info) {
+			delete(et.m, key)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package funcache
+
+// The optional methods a store can have, beyond those of Store, which the cache
+// looks for (e.g. Delete needs a RemovableStore).
+type storeCaps uint8
+
+const (
+	canRemove storeCaps = 1 << iota
+	canPurge
+	canCount
+	canEnumerate
+
+	allCaps = canRemove | canPurge | canCount | canEnumerate
+)
+
+// Return which of the optional methods all of the given stores have.
+func capsOf(stores ...Store) storeCaps {
+	caps := allCaps
+	for _, store := range stores {
+		if _, ok := store.(RemovableStore); !ok {
+			caps &^= canRemove
+		}
+		if _, ok := store.(PurgeableStore); !ok {
+			caps &^= canPurge
+		}
+		if _, ok := store.(CountableStore); !ok {
+			caps &^= canCount
+		}
+		if _, ok := store.(EnumerableStore); !ok {
+			caps &^= canEnumerate
+		}
+	}
+	return caps
+}
+
+type remover interface{ Remove(key interface{}) }
+type purger interface{ Purge() }
+type counter interface{ Len() int }
+type enumerator interface{ Keys() []interface{} }
+
+// Return the store wrapped up so that it only has the optional methods given,
+// which it must have. This is for stores which wrap others, so that they don't
+// claim to do what the stores they wrap can't. Otherwise, Delete would seem to
+// work, but leave the value there.
+func withCaps(store Store, caps storeCaps) Store {
+	r, _ := store.(remover)
+	p, _ := store.(purger)
+	c, _ := store.(counter)
+	e, _ := store.(enumerator)
+	switch caps {
+	case 0:
+		return struct{ Store }{store}
+	case canRemove:
+		return struct {
+			Store
+			remover
+		}{store, r}
+	case canPurge:
+		return struct {
+			Store
+			purger
+		}{store, p}
+	case canRemove | canPurge:
+		return struct {
+			Store
+			remover
+			purger
+		}{store, r, p}
+	case canCount:
+		return struct {
+			Store
+			counter
+		}{store, c}
+	case canRemove | canCount:
+		return struct {
+			Store
+			remover
+			counter
+		}{store, r, c}
+	case canPurge | canCount:
+		return struct {
+			Store
+			purger
+			counter
+		}{store, p, c}
+	case canRemove | canPurge | canCount:
+		return struct {
+			Store
+			remover
+			purger
+			counter
+		}{store, r, p, c}
+	case canEnumerate:
+		return struct {
+			Store
+			enumerator
+		}{store, e}
+	case canRemove | canEnumerate:
+		return struct {
+			Store
+			remover
+			enumerator
+		}{store, r, e}
+	case canPurge | canEnumerate:
+		return struct {
+			Store
+			purger
+			enumerator
+		}{store, p, e}
+	case canRemove | canPurge | canEnumerate:
+		return struct {
+			Store
+			remover
+			purger
+			enumerator
+		}{store, r, p, e}
+	case canCount | canEnumerate:
+		return struct {
+			Store
+			counter
+			enumerator
+		}{store, c, e}
+	case canRemove | canCount | canEnumerate:
+		return struct {
+			Store
+			remover
+			counter
+			enumerator
+		}{store, r, c, e}
+	case canPurge | canCount | canEnumerate:
+		return struct {
+			Store
+			purger
+			counter
+			enumerator
+		}{store, p, c, e}
+	}
+	return store
+}
@@ -0,0 +1,236 @@
+package funcache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// The key fields of each struct type used with StructKey, by index.
+var structKeyFields sync.Map
+
+var interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// Keys made by StructKey. The values of the key fields are held in an array,
+// which is comparable as long as they are.
+type structKey struct {
+	typ    reflect.Type
+	fields interface{}
+}
+
+// StructKey returns a cache key made up of those fields of the given struct
+// which are tagged `funcache:"key"`. Other fields don't affect the key. For
+// example, with:
+//
+//	type Request struct {
+//		UserID    int    `funcache:"key"`
+//		Scope     string `funcache:"key"`
+//		Timestamp time.Time
+//	}
+//
+// requests for the same user and scope have the same key, whatever their
+// timestamps. Pointers to structs can be given too. StructKey panics if any of
+// the key fields are unexported, or of a type that isn't comparable. Values
+// that aren't comparable held in interface fields are hashed, as with any other
+// key.
+func StructKey(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("funcache: StructKey needs a struct, not %T", v))
+	}
+	fields := keyFields(rv.Type())
+	values := reflect.New(reflect.ArrayOf(len(fields), interfaceType)).Elem()
+	for i, index := range fields {
+		field := rv.Field(index)
+		if !field.Comparable() { // An interface holding something that isn't
+			field = reflect.ValueOf(normalizeKey(field.Interface()))
+		}
+		values.Index(i).Set(field)
+	}
+	return structKey{rv.Type(), values.Interface()}
+}
+
+// Return the indexes of the key fields of the struct type.
+func keyFields(t reflect.Type) []int {
+	if fields, ok := structKeyFields.Load(t); ok {
+		return fields.([]int)
+	}
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("funcache") != "key" {
+			continue
+		}
+		if field.PkgPath != "" {
+			panic(fmt.Sprintf("funcache: key field %s.%s is unexported", t, field.Name))
+		}
+		if !field.Type.Comparable() {
+			panic(fmt.Sprintf("funcache: key field %s.%s is of non-comparable type %s", t, field.Name, field.Type))
+		}
+		fields = append(fields, i)
+	}
+	structKeyFields.Store(t, fields)
+	return fields
+}
+
+// Keys made by normalizeKey, from values that can't be used as map keys.
+type unhashableKey struct {
+	typ  reflect.Type
+	hash uint64
+}
+
+// Return a form of the key that can be used as a map key. Keys that aren't
+// comparable (slices, maps, funcs, or structs and arrays holding them, even in
+// interface fields) would make maps panic, so they're replaced by their type
+// and a hash of their value (see hashKey). Other keys are returned as they are.
+func normalizeKey(key interface{}) interface{} {
+	switch key.(type) {
+	case nil, string, int, int64, uint64, unhashableKey, structKey:
+		return key // Fast path for the most common keys
+	}
+	if v := reflect.ValueOf(key); !v.Comparable() {
+		return unhashableKey{v.Type(), hashKey(key)}
+	}
+	return key
+}
+
+// HashKey returns a 64-bit hash of the key's value, the same as the cache uses
+// for keys which aren't hashable. It's for stores which only take some kinds of
+// keys, like strings and numbers, to store any others under. Keys the cache
+// makes up itself, like those of WrapArgs, Namespace or StructKey, can be
+// hashed too.
+func HashKey(key interface{}) uint64 { return hashKey(key) }
+
+// Return a hash of the value, using FNV-1a over a walk of everything in it.
+// Equal values hash the same, in any run of the program: pointers are followed
+// rather than hashed by address, and maps hash the same whatever order their
+// entries were added in. Unequal values (including the same value in different
+// types) hash differently, short of a collision, which is very unlikely. Funcs
+// and channels are hashed by identity, as that's all there is to them, and
+// reflect.Types by name.
+func hashKey(v interface{}) uint64 {
+	kh := keyHasher{w: fnv.New64a(), following: make(map[uintptr]bool)}
+	kh.typed(reflect.ValueOf(v))
+	return kh.w.Sum64()
+}
+
+// The type behind every reflect.Type.
+var rtypePtrType = reflect.TypeOf(reflect.TypeOf(0))
+
+type keyHasher struct {
+	w         hash.Hash64
+	buf       [8]byte
+	following map[uintptr]bool // Pointers and maps being walked, to stop at cycles
+}
+
+func (kh *keyHasher) uint(n uint64) {
+	binary.LittleEndian.PutUint64(kh.buf[:], n)
+	kh.w.Write(kh.buf[:])
+}
+
+func (kh *keyHasher) string(s string) {
+	kh.uint(uint64(len(s)))
+	io.WriteString(kh.w, s)
+}
+
+func (kh *keyHasher) bool(b bool) {
+	if b {
+		kh.uint(1)
+	} else {
+		kh.uint(0)
+	}
+}
+
+// Hash the type of the value along with it, for when it isn't known up front.
+func (kh *keyHasher) typed(v reflect.Value) {
+	if !v.IsValid() {
+		kh.string("nil")
+		return
+	}
+	kh.string(v.Type().PkgPath() + " " + v.Type().String())
+	kh.value(v)
+}
+
+func (kh *keyHasher) value(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		kh.bool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		kh.uint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		kh.uint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		kh.uint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		kh.uint(math.Float64bits(real(v.Complex())))
+		kh.uint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		kh.string(v.String())
+	case reflect.Slice:
+		kh.bool(v.IsNil())
+		fallthrough
+	case reflect.Array:
+		kh.uint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			kh.value(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			kh.value(v.Field(i))
+		}
+	case reflect.Interface:
+		kh.typed(v.Elem())
+	case reflect.Ptr:
+		if v.Type() == rtypePtrType && !v.IsNil() {
+			// Held in a field, so v.Interface() isn't allowed; but it's safe
+			// to look at a type.
+			t := reflect.NewAt(v.Type().Elem(), unsafe.Pointer(v.Pointer())).Interface().(reflect.Type)
+			kh.string(t.PkgPath() + " " + t.String())
+			return
+		}
+		kh.follow(v, func() { kh.value(v.Elem()) })
+	case reflect.Map:
+		kh.follow(v, func() {
+			// Each entry is hashed on its own, and the hashes are summed, so
+			// that the order doesn't matter.
+			kh.uint(uint64(v.Len()))
+			var sum uint64
+			for iter := v.MapRange(); iter.Next(); {
+				entry := keyHasher{w: fnv.New64a(), following: kh.following}
+				entry.value(iter.Key())
+				entry.value(iter.Value())
+				sum += entry.w.Sum64()
+			}
+			kh.uint(sum)
+		})
+	default: // Funcs, channels and unsafe pointers
+		kh.uint(uint64(v.Pointer()))
+	}
+}
+
+// Hash what the pointer or map refers to, unless it's nil, or we're already in
+// the middle of hashing it.
+func (kh *keyHasher) follow(v reflect.Value, walk func()) {
+	if v.IsNil() {
+		kh.uint(0)
+		return
+	}
+	ptr := v.Pointer()
+	if kh.following[ptr] {
+		kh.uint(1) // A cycle
+		return
+	}
+	kh.uint(2)
+	kh.following[ptr] = true
+	defer delete(kh.following, ptr)
+	walk()
+}
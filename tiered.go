@@ -0,0 +1,42 @@
+package funcache
+
+// NewTiered returns a store with a fast first tier (l1, e.g. in memory) in
+// front of a slower second tier (l2, e.g. shared over the network). Values are
+// looked up in l1 first, then l2; any found in l2 are copied into l1 for next
+// time. Values are written to both. Removing and purging keys are supported
+// only if both tiers support them, since a value left in l2 would come back.
+func NewTiered(l1, l2 Store) Store {
+	return withCaps(&tieredStore{l1: l1, l2: l2}, capsOf(l1, l2)&(canRemove|canPurge))
+}
+
+// -----------------------------------------------------------------------------
+// Two tiers of stores, safe for concurrent access (as long as they are).
+
+type tieredStore struct {
+	l1, l2 Store
+}
+
+func (ts *tieredStore) Add(key, value interface{}) {
+	ts.l1.Add(key, value)
+	ts.l2.Add(key, value)
+}
+
+func (ts *tieredStore) Get(key interface{}) (value interface{}, ok bool) {
+	if value, ok = ts.l1.Get(key); ok {
+		return
+	}
+	if value, ok = ts.l2.Get(key); ok {
+		ts.l1.Add(key, value)
+	}
+	return
+}
+
+func (ts *tieredStore) Remove(key interface{}) {
+	ts.l1.(RemovableStore).Remove(key)
+	ts.l2.(RemovableStore).Remove(key)
+}
+
+func (ts *tieredStore) Purge() {
+	ts.l1.(PurgeableStore).Purge()
+	ts.l2.(PurgeableStore).Purge()
+}
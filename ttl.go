@@ -0,0 +1,309 @@
+package funcache
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock tells the time, for expiring cached values. The default is the system
+// clock, but any other can be used (e.g. for testing) by passing WithClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// TickerClock is a Clock which can also make tickers, for refreshing values on
+// a schedule (see CacheTimed). If the cache's clock isn't one, real tickers
+// are used.
+type TickerClock interface {
+	Clock
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on a channel at intervals, until it's stopped.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct{ *time.Ticker }
+
+func (st systemTicker) C() <-chan time.Time { return st.Ticker.C }
+
+// Values that expire are wrapped up like this in the store.
+type ttlEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// Unwrap the data from the store, returning false if it's expired.
+func (cache *Cache) unwrap(data interface{}) (value interface{}, ok bool) {
+	if entry, ok := data.(ttlEntry); ok {
+		if !cache.clock.Now().Before(entry.expiresAt) {
+			return nil, false
+		}
+		return entry.value, true
+	}
+	return data, true
+}
+
+func isExpiring(data interface{}) bool {
+	_, ok := data.(ttlEntry)
+	return ok
+}
+
+// The value of an entry, whether it's expired or not.
+func unexpire(data interface{}) interface{} {
+	if entry, ok := data.(ttlEntry); ok {
+		return entry.value
+	}
+	return data
+}
+
+// CacheWithTTL caches the return value of the function, like Cache, except that
+// the value expires after the given TTL, and is then recomputed. A TTL of zero
+// or less means the value never expires, just like with Cache.
+func (cache *Cache) CacheWithTTL(key interface{}, ttl time.Duration, fn func() interface{}) interface{} {
+	if ttl <= 0 {
+		return cache.Cache(key, fn)
+	}
+	return cache.CacheTTLFunc(key, fn, func(interface{}) time.Duration { return ttl })
+}
+
+// CacheTTLFunc caches the return value of the function, like Cache, except that
+// the value expires after some time. How long is decided by calling ttlOf with
+// the value; this lets values carry their own freshness (e.g. an HTTP response
+// with a max-age). If ttlOf returns zero or less, the value isn't cached.
+//
+// Any value found under the key without an expiry, such as one stored by Set or
+// by another program sharing the store, is treated as missing and recomputed.
+func (cache *Cache) CacheTTLFunc(key interface{}, fn func() interface{}, ttlOf func(value interface{}) time.Duration) interface{} {
+	key = cache.resolve(key)
+	if value, ok, _ := cache.find(key, bustByStack, nil, true); ok {
+		return value
+	}
+	value := cache.compute(key, fn)
+	if ttl := ttlOf(value); ttl > 0 {
+		cache.add(key, ttlEntry{value, cache.clock.Now().Add(cache.jittered(ttl))})
+	}
+	return value
+}
+
+// Randomly spread out the TTL by the jitter, if any.
+func (cache *Cache) jittered(ttl time.Duration) time.Duration {
+	if cache.ttlJitter <= 0 {
+		return ttl
+	}
+	spread := time.Duration(float64(ttl) * cache.ttlJitter)
+	return ttl - spread + cache.rand.duration(2*spread+1)
+}
+
+// If the key was computed within the minimum recompute interval, return the
+// value we have for it (even if it's expired).
+func (cache *Cache) recent(key interface{}) (value interface{}, ok bool) {
+	if cache.minRecompute <= 0 {
+		return nil, false
+	}
+	at, ok := cache.computedAt.get(key)
+	if !ok || cache.clock.Now().Sub(at) >= cache.minRecompute {
+		return nil, false
+	}
+	data, ok := cache.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return unexpire(data), true
+}
+
+// The value stored for the key, even if it's expired, as long as it passes the
+// check (or the type guard, without one). This is returned while a new value is
+// being computed, if we're not blocking on hot keys.
+func (cache *Cache) stale(key interface{}, check func(value interface{}) bool) (value interface{}, ok bool) {
+	data, ok := cache.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+	value = unexpire(data)
+	if check == nil && cache.typeGuard != nil {
+		check = func(value interface{}) bool { return isAssignable(value, cache.typeGuard) }
+	}
+	if check != nil && !check(value) {
+		return nil, false
+	}
+	return value, true
+}
+
+// CacheTimed computes the value of the function and caches it, and then keeps
+// recomputing it in the background, every so often, until the returned stop
+// func is called. This makes a value that refreshes itself, without anyone
+// waiting on it. Calling CacheTimed again for the same key, while it's still
+// running, doesn't start another refresh, but returns a way to stop the first.
+// The function may itself call CacheTimed, to refresh other keys.
+//
+// Once stop returns, the value won't be refreshed again. If a refresh panics,
+// the old value is kept until the next one.
+func (cache *Cache) CacheTimed(key interface{}, every time.Duration, fn func() interface{}) (stop func()) {
+	key = cache.resolve(key)
+	cache.timers.Lock()
+	if t, ok := cache.timers.m[key]; ok {
+		cache.timers.Unlock()
+		return t.stop
+	}
+	t := &timer{done: make(chan struct{})}
+	t.stop = func() {
+		t.once.Do(func() {
+			cache.timers.Lock()
+			if cache.timers.m[key] == t {
+				delete(cache.timers.m, key)
+			}
+			close(t.done)
+			cache.timers.Unlock()
+		})
+		t.wg.Wait()
+	}
+	if cache.timers.m == nil {
+		cache.timers.m = make(map[interface{}]*timer)
+	}
+	cache.timers.m[key] = t
+	cache.timers.Unlock()
+
+	// Compute the first value without holding the lock, so that fn can call
+	// CacheTimed (or stop) itself. If it panics, give up the key.
+	computed := false
+	defer func() {
+		if !computed {
+			t.stop()
+		}
+	}()
+	cache.add(key, cache.compute(key, fn))
+	computed = true
+
+	cache.timers.Lock()
+	defer cache.timers.Unlock()
+	select {
+	case <-t.done:
+		return t.stop // Already stopped
+	default:
+	}
+	var ticker Ticker
+	if clock, ok := cache.clock.(TickerClock); ok {
+		ticker = clock.NewTicker(every)
+	} else {
+		ticker = systemClock{}.NewTicker(every)
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C():
+				cache.refresh(key, fn)
+			}
+		}
+	}()
+	return t.stop
+}
+
+// Recompute and store the value for the key, keeping the old one if fn panics.
+func (cache *Cache) refresh(key interface{}, fn func() interface{}) {
+	defer func() { recover() }()
+	cache.add(key, cache.compute(key, fn))
+}
+
+// Values being refreshed by CacheTimed, by key.
+type timerMap struct {
+	sync.Mutex
+	m map[interface{}]*timer
+}
+
+type timer struct {
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+	stop func()
+}
+
+// PurgeOlderThan removes all entries stored before the given time, returning
+// how many were removed. The cache must have been created WithEntryTracking,
+// and its store must be a RemovableStore; otherwise nothing is removed.
+func (cache *Cache) PurgeOlderThan(cutoff time.Time) int {
+	store, ok := cache.store.(RemovableStore)
+	if !ok {
+		return 0
+	}
+	var n int
+	cache.entries.deleteIf(func(key interface{}, info *entryInfo) bool {
+		if !info.createdAt.Before(cutoff) {
+			return false
+		}
+		if _, ok := store.Get(key); ok {
+			store.Remove(key)
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// -----------------------------------------------------------------------------
+// Map of keys to times, safe for concurrent access.
+
+type timeMap struct {
+	sync.RWMutex
+	m map[interface{}]time.Time
+}
+
+func (tm *timeMap) set(key interface{}, t time.Time) {
+	tm.Lock()
+	defer tm.Unlock()
+	if tm.m == nil {
+		tm.m = make(map[interface{}]time.Time)
+	}
+	tm.m[key] = t
+}
+
+func (tm *timeMap) get(key interface{}) (t time.Time, ok bool) {
+	tm.RLock()
+	defer tm.RUnlock()
+	t, ok = tm.m[key]
+	return
+}
+
+// ErrNotFound can be returned by functions being cached to mark that there's no
+// value for a key. It's cached like any other value, unless the cache is made
+// with WithNegativeTTL, in which case it expires after a short while.
+var ErrNotFound = errors.New("funcache: not found")
+
+func isNotFound(data interface{}) bool {
+	err, ok := data.(error)
+	return ok && errors.Is(err, ErrNotFound)
+}
+
+// A random source that's safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// A random duration in [0, max).
+func (lr *lockedRand) duration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if lr.r == nil {
+		lr.r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return time.Duration(lr.r.Int63n(int64(max)))
+}
@@ -0,0 +1,66 @@
+package funcache
+
+// TypedCache is a type-safe view of a Cache, for keys of type K and values of
+// type V. Values are boxed and unboxed for you, so there's no need for type
+// assertions. Several typed views can share one Cache (and its store), as long
+// as they don't share keys.
+type TypedCache[K comparable, V any] struct {
+	cache *Cache
+}
+
+// Typed returns a typed view of the given cache.
+func Typed[K comparable, V any](cache *Cache) *TypedCache[K, V] {
+	return &TypedCache[K, V]{cache}
+}
+
+// Untyped returns the underlying Cache.
+func (tc *TypedCache[K, V]) Untyped() *Cache { return tc.cache }
+
+// Cache caches the return value of the given function, like Cache.Cache. Any
+// value found under the key that isn't a V is treated as missing, and
+// recomputed.
+func (tc *TypedCache[K, V]) Cache(key K, fn func() V) V {
+	return tc.cacheAs(key, fn)
+}
+
+// Wrap caches the return value of the given function, like Cache.Wrap. The key
+// is the function name.
+func (tc *TypedCache[K, V]) Wrap(fn func() V) V {
+	return tc.cacheAs(getFnName(fn), fn)
+}
+
+func (tc *TypedCache[K, V]) cacheAs(key interface{}, fn func() V) V {
+	value, _ := tc.cache.cacheHit(key, bustByStack, isTyped[V], func() interface{} { return fn() })
+	typed, _ := tc.cache.copied(value).(V) // The zero value, if nil
+	return typed
+}
+
+// CacheTyped2 caches both return values of the function, like Cache.Cache2,
+// but with their types kept. A pair found under the key that isn't an A and a B
+// is treated as missing, and recomputed.
+func CacheTyped2[A, B any](cache *Cache, key interface{}, fn func() (A, B)) (A, B) {
+	data, _ := cache.cacheHit(key, bustByStack, isTypedPair[A, B], func() interface{} {
+		first, second := fn()
+		return pairEntry{first, second}
+	})
+	entry := data.(pairEntry)
+	first, _ := entry.first.(A)
+	second, _ := entry.second.(B)
+	return first, second
+}
+
+// WrapTyped2 is the same as CacheTyped2, with the function name as the key.
+func WrapTyped2[A, B any](cache *Cache, fn func() (A, B)) (A, B) {
+	return CacheTyped2(cache, getFnName(fn), fn)
+}
+
+func isTypedPair[A, B any](data interface{}) bool {
+	entry, ok := data.(pairEntry)
+	return ok && isTyped[A](entry.first) && isTyped[B](entry.second)
+}
+
+// Whether the value is a V, or nil (which some Vs can be).
+func isTyped[V any](value interface{}) bool {
+	_, ok := value.(V)
+	return ok || value == nil
+}
@@ -0,0 +1,87 @@
+package funcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypedCache(t *testing.T) {
+	cache := NewInMemCache()
+	names := Typed[int, string](cache)
+	counts := Typed[string, int](cache)
+
+	var callCount int
+	getName := func(id int) string {
+		return names.Cache(id, func() string {
+			callCount += 1
+			return "Foo!"
+		})
+	}
+	assert.Equal(t, "Foo!", getName(1))
+	assert.Equal(t, "Foo!", getName(1))
+	assert.Equal(t, 1, callCount)
+
+	assert.Equal(t, 42, counts.Cache("bar", func() int { return 42 }))
+	assert.Equal(t, 42, counts.Wrap(func() int { return 42 }))
+	assert.Same(t, cache, counts.Untyped())
+
+	// A value of the wrong type is recomputed, rather than panicking.
+	cache.Cache("drift", func() interface{} { return 1 })
+	assert.Equal(t, "Drift!", Typed[string, string](cache).Cache("drift", func() string { return "Drift!" }))
+
+	// Nil values unbox to the zero value.
+	errs := Typed[string, error](cache)
+	assert.Nil(t, errs.Cache("none", func() error { return nil }))
+	assert.Nil(t, errs.Cache("none", func() error { panic("shouldn't recompute") }))
+
+	cache.Bust(func() {
+		assert.Equal(t, "Foo!", getName(1))
+	})
+	assert.Equal(t, 2, callCount)
+}
+
+func TestCacheTyped2(t *testing.T) {
+	cache := NewInMemCache()
+
+	var callCount int
+	lookup := func() (int, bool) {
+		callCount += 1
+		return callCount * 10, true
+	}
+	value, ok := CacheTyped2(cache, "foo", lookup)
+	assert.Equal(t, 10, value)
+	assert.True(t, ok)
+	value, ok = WrapTyped2(cache, lookup)
+	assert.Equal(t, 20, value)
+	assert.True(t, ok)
+	value, ok = CacheTyped2(cache, "foo", lookup)
+	assert.Equal(t, 10, value)
+	assert.True(t, ok)
+	assert.Equal(t, 2, callCount)
+
+	// A pair of the wrong types is recomputed.
+	name, err := CacheTyped2(cache, "foo", func() (string, error) { return "Foo!", nil })
+	assert.Equal(t, "Foo!", name)
+	assert.Nil(t, err)
+}
+
+// Closures here are named the same for every T, though the code differs.
+func wrapTestLoader[T any](value T) func() interface{} {
+	return func() interface{} { return value }
+}
+
+func TestWrapExact(t *testing.T) {
+	loadInt, loadString := wrapTestLoader(42), wrapTestLoader("Foo!")
+	assert.Equal(t, KeyForFunc(loadInt), KeyForFunc(loadString))
+
+	cache := NewInMemCache()
+	assert.Equal(t, 42, cache.Wrap(loadInt))
+	assert.Equal(t, 42, cache.Wrap(loadString)) // Same key, so a collision
+
+	cache = NewInMemCache()
+	assert.Equal(t, 42, cache.WrapExact(loadInt))
+	assert.Equal(t, "Foo!", cache.WrapExact(loadString))
+	assert.Equal(t, 42, cache.WrapExact(loadInt))
+	assert.Equal(t, 2, cache.Len())
+}
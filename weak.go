@@ -0,0 +1,134 @@
+//go:build go1.24
+
+package funcache
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"unsafe"
+	"weak"
+)
+
+// NewWeakCache returns a Cache backed by an in-memory store which doesn't keep
+// its keys alive. Once nothing else refers to a key, the garbage collector can
+// reclaim it, and its value is removed from the store some time after. This is
+// for caching values about long-lived objects, like sessions or connections,
+// without leaking them.
+//
+// Only pointer keys are held weakly (and not pointers to zero-sized types);
+// any other keys are kept like in NewInMemCache. Keys are also kept alive by
+// any values which refer to them, and by options which track keys, such as
+// WithEntryTracking, or by using a Namespace. It's all best effort: exactly
+// when values are removed depends on the garbage collector.
+func NewWeakCache(opts ...Option) *Cache { return New(newWeakStore(), opts...) }
+
+// -----------------------------------------------------------------------------
+// Map with weakly held pointer keys, safe for concurrent access.
+
+type weakStore struct {
+	sync.RWMutex
+	weak   map[weakKey]interface{}
+	strong map[interface{}]interface{} // Any keys which can't be weak
+}
+
+// Pointers to different types can share an address (like a struct and its
+// first field), so the type is part of the key.
+type weakKey struct {
+	typ reflect.Type
+	ptr weak.Pointer[byte]
+}
+
+func newWeakStore() *weakStore {
+	return &weakStore{
+		weak:   make(map[weakKey]interface{}),
+		strong: make(map[interface{}]interface{}),
+	}
+}
+
+// Return the weak form of the key, along with what it points to, if it can be
+// held weakly.
+func makeWeakKey(key interface{}) (wk weakKey, ptr *byte, ok bool) {
+	v := reflect.ValueOf(key)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Type().Elem().Size() == 0 {
+		return weakKey{}, nil, false
+	}
+	ptr = (*byte)(v.UnsafePointer())
+	return weakKey{v.Type(), weak.Make(ptr)}, ptr, true
+}
+
+func (ws *weakStore) Add(key, value interface{}) {
+	wk, ptr, ok := makeWeakKey(key)
+	if !ok {
+		key = normalizeKey(key)
+		ws.Lock()
+		ws.strong[key] = value
+		ws.Unlock()
+		return
+	}
+	ws.Lock()
+	_, exists := ws.weak[wk]
+	ws.weak[wk] = value
+	ws.Unlock()
+	if !exists {
+		runtime.AddCleanup(ptr, ws.forget, wk)
+	}
+}
+
+func (ws *weakStore) forget(wk weakKey) {
+	ws.Lock()
+	defer ws.Unlock()
+	delete(ws.weak, wk)
+}
+
+func (ws *weakStore) Get(key interface{}) (value interface{}, ok bool) {
+	wk, _, weak := makeWeakKey(key)
+	ws.RLock()
+	defer ws.RUnlock()
+	if weak {
+		value, ok = ws.weak[wk]
+	} else {
+		value, ok = ws.strong[normalizeKey(key)]
+	}
+	return
+}
+
+func (ws *weakStore) Remove(key interface{}) {
+	wk, _, weak := makeWeakKey(key)
+	ws.Lock()
+	defer ws.Unlock()
+	if weak {
+		delete(ws.weak, wk)
+	} else {
+		delete(ws.strong, normalizeKey(key))
+	}
+}
+
+func (ws *weakStore) Purge() {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.weak = make(map[weakKey]interface{})
+	ws.strong = make(map[interface{}]interface{})
+}
+
+func (ws *weakStore) Len() int {
+	ws.RLock()
+	defer ws.RUnlock()
+	return len(ws.weak) + len(ws.strong)
+}
+
+// Only keys which are still alive are listed.
+func (ws *weakStore) Keys() []interface{} {
+	ws.RLock()
+	defer ws.RUnlock()
+	keys := make([]interface{}, 0, len(ws.weak)+len(ws.strong))
+	for wk := range ws.weak {
+		if ptr := wk.ptr.Value(); ptr != nil {
+			keys = append(keys, reflect.NewAt(wk.typ.Elem(), unsafe.Pointer(ptr)).Interface())
+		}
+	}
+	for k := range ws.strong {
+		keys = append(keys, k)
+	}
+	return keys
+}
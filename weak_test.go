@@ -0,0 +1,46 @@
+//go:build go1.24
+
+package funcache
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type weakTestSession struct {
+	id   int
+	data [64]byte // Big enough not to share an allocation with anything else
+}
+
+func TestWeakCache(t *testing.T) {
+	cache := NewWeakCache()
+
+	kept := &weakTestSession{id: -1}
+	testCacheUse(t, cache, kept, "Kept", true)
+	testCacheUse(t, cache, kept, "Kept", false)
+	testCacheUse(t, cache, "plain", "Plain", true)
+	func() {
+		for i := 0; i < 100; i++ {
+			cache.Set(&weakTestSession{id: i}, i)
+		}
+	}()
+	assert.Equal(t, 102, cache.Len())
+
+	// Once the keys are unreachable, their values go too, eventually.
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Len() > 2 && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 2, cache.Len())
+	assert.ElementsMatch(t, []interface{}{kept, "plain"}, cache.Keys())
+
+	testCacheUse(t, cache, kept, "Kept", false)
+	testCacheUse(t, cache, "plain", "Plain", false)
+	cache.Delete(kept)
+	testCacheUse(t, cache, kept, "Kept", true)
+	runtime.KeepAlive(kept)
+}
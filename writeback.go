@@ -0,0 +1,148 @@
+package funcache
+
+import (
+	"sync"
+	"time"
+)
+
+// NewWriteBackCache returns a Cache backed by a fast in-memory store in front
+// of a slower backing store. Values are written to mem right away, and flushed
+// to backing in batches, every flushInterval. Values not found in mem are
+// looked up in backing (and then kept in mem). Values not flushed yet are still
+// found, even if mem has evicted them.
+//
+// The returned func stops flushing, after doing a final flush of any pending
+// writes. Call it when you're done with the cache. The flushInterval must be
+// positive.
+func NewWriteBackCache(mem, backing Store, flushInterval time.Duration, opts ...Option) (*Cache, func()) {
+	if flushInterval <= 0 {
+		panic("funcache: flushInterval must be positive")
+	}
+	store := newWriteBackStore(mem, backing)
+	go store.run(flushInterval)
+	return New(store, opts...), store.close
+}
+
+// -----------------------------------------------------------------------------
+// Write-back store, batching writes to the backing store, safe for concurrent
+// access (as long as the stores it wraps are).
+
+type writeBackStore struct {
+	mem, backing Store
+
+	// Held while writing to mem, so that it always agrees with dirty.
+	mu     sync.Mutex
+	dirty  map[interface{}]interface{} // Written to mem, not yet to backing
+	writes uint64                      // Count of writes, to spot any during a read
+
+	// Held while flushing, and while removing from backing, so that a removed
+	// value can't be flushed back after it's gone.
+	flushMu sync.Mutex
+
+	stop, done chan struct{}
+	stopOnce   sync.Once
+}
+
+func newWriteBackStore(mem, backing Store) *writeBackStore {
+	return &writeBackStore{
+		mem:     mem,
+		backing: backing,
+		dirty:   make(map[interface{}]interface{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (ws *writeBackStore) Add(key, value interface{}) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.mem.Add(key, value)
+	ws.dirty[key] = value
+	ws.writes++
+}
+
+// Values not yet flushed are found even if mem has since evicted them, so
+// reads always see the latest writes.
+func (ws *writeBackStore) Get(key interface{}) (value interface{}, ok bool) {
+	ws.mu.Lock()
+	value, ok = ws.dirty[key]
+	writes := ws.writes
+	ws.mu.Unlock()
+	if ok {
+		return
+	}
+	if value, ok = ws.mem.Get(key); ok {
+		return
+	}
+	if value, ok = ws.backing.Get(key); ok {
+		ws.mu.Lock()
+		defer ws.mu.Unlock()
+		if ws.writes == writes { // Otherwise, what we read could be stale
+			ws.mem.Add(key, value)
+		}
+	}
+	return
+}
+
+func (ws *writeBackStore) Remove(key interface{}) {
+	ws.flushMu.Lock()
+	defer ws.flushMu.Unlock()
+	ws.mu.Lock()
+	delete(ws.dirty, key)
+	if mem, ok := ws.mem.(RemovableStore); ok {
+		mem.Remove(key)
+	}
+	ws.writes++
+	ws.mu.Unlock()
+	if backing, ok := ws.backing.(RemovableStore); ok {
+		backing.Remove(key)
+	}
+}
+
+func (ws *writeBackStore) Purge() {
+	ws.flushMu.Lock()
+	defer ws.flushMu.Unlock()
+	ws.mu.Lock()
+	ws.dirty = make(map[interface{}]interface{})
+	if mem, ok := ws.mem.(PurgeableStore); ok {
+		mem.Purge()
+	}
+	ws.writes++
+	ws.mu.Unlock()
+	if backing, ok := ws.backing.(PurgeableStore); ok {
+		backing.Purge()
+	}
+}
+
+// Write everything pending to the backing store.
+func (ws *writeBackStore) flush() {
+	ws.flushMu.Lock()
+	defer ws.flushMu.Unlock()
+	ws.mu.Lock()
+	dirty := ws.dirty
+	ws.dirty = make(map[interface{}]interface{})
+	ws.mu.Unlock()
+	for key, value := range dirty {
+		ws.backing.Add(key, value)
+	}
+}
+
+func (ws *writeBackStore) run(interval time.Duration) {
+	defer close(ws.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ws.flush()
+		case <-ws.stop:
+			ws.flush()
+			return
+		}
+	}
+}
+
+func (ws *writeBackStore) close() {
+	ws.stopOnce.Do(func() { close(ws.stop) })
+	<-ws.done
+}